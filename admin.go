@@ -0,0 +1,47 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/logger"
+)
+
+// adminOnly protects operator endpoints by a bearer token. Without a configured token they do not exist
+func (s *server) adminOnly(f httpx.RequestHandler) httpx.RequestHandler {
+	return func(r *http.Request) (*httpx.Response, error) {
+		if s.conf.adminToken == "" {
+			return nil, httpx.NewError(http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		}
+		if !s.isAdmin(r) {
+			return nil, errUnauthorized
+		}
+		return f(r)
+	}
+}
+
+// isAdmin checks if a request carries the admin token
+func (s *server) isAdmin(r *http.Request) bool {
+	if s.conf.adminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.adminToken)) == 1
+}
+
+func (s *server) logLevel(r *http.Request) (*httpx.Response, error) {
+	req := map[string]string{}
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	level, err := logger.ParseLevel(req["level"])
+	if err != nil {
+		return nil, httpx.NewError(http.StatusBadRequest, err.Error())
+	}
+	prev := logger.GetLevel()
+	logger.SetLevel(level)
+	logger.Error.Printf("log level changed from=%s to=%s", prev, level) // always visible
+	return httpx.JSON(http.StatusOK, m{"level": level.String()}), nil
+}
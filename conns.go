@@ -0,0 +1,69 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nchern/vpoker/pkg/logger"
+)
+
+// connTracker keeps web socket connections of each user so that a buggy client
+// can not open unlimited number of them
+type connTracker struct {
+	lock sync.Mutex
+
+	// max is a number of connections a user can have, zero means unlimited
+	max int
+
+	conns map[uuid.UUID][]*websocket.Conn
+}
+
+func newConnTracker(max int) *connTracker {
+	return &connTracker{max: max, conns: map[uuid.UUID][]*websocket.Conn{}}
+}
+
+// add registers a connection of a given user closing the oldest ones above the limit.
+// The returned func must be called once the connection is finished
+func (c *connTracker) add(userID uuid.UUID, conn *websocket.Conn) func() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conns := append(c.conns[userID], conn)
+	for c.max > 0 && len(conns) > c.max {
+		logger.Info.Printf("user_id=%s too many web socket connections: closing the oldest", userID)
+		oldest := conns[0]
+		conns = conns[1:]
+		// closing makes the read pump of that connection fail which finishes it
+		logError(oldest.Close(), "connTracker oldest.Close")
+	}
+	c.conns[userID] = conns
+	return func() { c.remove(userID, conn) }
+}
+
+func (c *connTracker) remove(userID uuid.UUID, conn *websocket.Conn) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	conns := c.conns[userID]
+	for i, it := range conns {
+		if it == conn {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(c.conns, userID)
+		return
+	}
+	c.conns[userID] = conns
+}
+
+// count returns a total number of tracked connections
+func (c *connTracker) count() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	n := 0
+	for _, conns := range c.conns {
+		n += len(conns)
+	}
+	return n
+}
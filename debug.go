@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/logger"
+	"github.com/nchern/vpoker/pkg/poker"
+)
+
+// defaultSeedTableSeed gives the deck order of seeded tables if none is requested
+const defaultSeedTableSeed = "0000000000000000"
+
+// SeedTableRequest describes a table with a known state
+type SeedTableRequest struct {
+	ID       uuid.UUID `json:"id"`
+	Name     string    `json:"name"`
+	Template string    `json:"template"`
+	// Seed is a hex encoded seed of the deck order, see poker.FairShuffle
+	Seed    string `json:"seed"`
+	Players []struct {
+		ID   uuid.UUID `json:"id"`
+		Name string    `json:"name"`
+	} `json:"players"`
+}
+
+// seedTable creates a table in a deterministic state for tests and demos.
+// It replaces a table with the same id and is only available in the debug mode
+func (s *server) seedTable(r *http.Request) (*httpx.Response, error) {
+	var req SeedTableRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	if req.ID == uuid.Nil {
+		return nil, httpx.NewError(http.StatusBadRequest, "id field is missing")
+	}
+	if len(req.Players) > maxPlayers {
+		return nil, httpx.NewError(http.StatusBadRequest, fmt.Sprintf("at most %d players", maxPlayers))
+	}
+	if req.Seed == "" {
+		req.Seed = defaultSeedTableSeed
+	}
+	tpl, err := poker.ParseTemplate(req.Template)
+	if err != nil {
+		return nil, err
+	}
+	table := poker.NewTable(req.ID, defaultBankChips)
+	table.Template = tpl
+	table.SetClock(s.clock)
+	table.SetOnChange(s.markDirty)
+	table.Name = strings.TrimSpace(req.Name)
+	table.StartGame()
+	if err := table.ShuffleWithSeed(req.Seed); err != nil {
+		return nil, err
+	}
+	table.BuyIn = s.conf.buyIn
+	now := s.clock.Now()
+	for i, p := range req.Players {
+		u, found := s.users.Get(p.ID)
+		if !found {
+			u = poker.NewUser(p.ID, p.Name, now)
+			s.users.Set(u.ID, u)
+		}
+		if i == 0 {
+			table.CreatedBy = u.ID
+		}
+		table.Join(u)
+	}
+	s.tables.Set(table.ID, table)
+	logger.Info.Printf("table_id=%s players=%d action=seed_table", table.ID, len(req.Players))
+	return httpx.JSON(http.StatusOK, newTableSummary(table)), nil
+}
+
+// streamRawPushes streams pushes dispatched to a player exactly as the server sends them,
+// before visibility rules are applied. It is only available in the debug mode to
+// the table creator or an admin
+func (s *server) streamRawPushes(w http.ResponseWriter, r *http.Request) {
+	httpx.H(s.authenticated(func(r *http.Request) (*httpx.Response, error) {
+		ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+		if err != nil {
+			return nil, err
+		}
+		playerID := ctx.user.ID
+		if v := r.URL.Query().Get("player"); v != "" {
+			if playerID, err = uuid.Parse(v); err != nil {
+				return nil, httpx.NewError(http.StatusBadRequest, "bad player id")
+			}
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, errors.New("streaming is not supported")
+		}
+		tap := poker.NewUpdates(s.conf.updatesBuffer)
+		if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+			if !t.IsCreator(ctx.user) && !s.isAdmin(r) {
+				return httpx.NewError(http.StatusForbidden, "only the creator or an admin can debug the table")
+			}
+			p := t.Players[playerID]
+			if p == nil {
+				return httpx.NewError(http.StatusNotFound, "player not found")
+			}
+			p.Tap(tap)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		defer func() {
+			logError(ctx.table.Update(context.Background(), func(t *poker.Table) error {
+				if p := t.Players[playerID]; p != nil {
+					p.Untap(tap)
+				}
+				return nil
+			}), "streamRawPushes untap")
+		}()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		sw := &sseWriter{w: w, f: flusher}
+		flusher.Flush()
+		logger.Info.Printf("%s player_id=%s debug_stream_start", ctx, playerID)
+		keepAlive := time.NewTicker(sseKeepAlivePeriod)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case push := <-tap:
+				err = sw.WriteJSON(push)
+			case <-keepAlive.C:
+				err = sw.keepAlive()
+			case <-r.Context().Done():
+				return nil, httpx.ErrFinished
+			}
+			if err != nil {
+				logger.Info.Printf("%s debug_stream_finish: %s", ctx, err)
+				return nil, httpx.ErrFinished
+			}
+		}
+	}))(w, r)
+}
+
+// setDeckOrderRequest lists ids of the cards in the deck pile starting from the top one
+type setDeckOrderRequest struct {
+	IDs []int `json:"ids"`
+}
+
+// setDeckOrder lets the creator stack the deck to set up a scripted hand for demos
+// and teaching. It is only available in the debug mode
+func (s *server) setDeckOrder(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req setDeckOrderRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can set the deck order")
+		}
+		return t.SetDeckOrder(req.IDs)
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=set_deck_order cards=%d", ctx, len(req.IDs))
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushRefresh())
+	return httpx.JSON(http.StatusOK, m{}), nil
+}
+
+// conjureCardRequest is a card to make up
+type conjureCardRequest struct {
+	Rank string     `json:"rank"`
+	Suit poker.Suit `json:"suit"`
+}
+
+// conjureCard puts a made up card into the caller's hand to reproduce bugs or set up
+// teaching scenarios with known hands. It is only available in the debug mode
+func (s *server) conjureCard(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req conjureCardRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		it, err := t.ConjureCard(p, req.Rank, req.Suit)
+		if err != nil {
+			return err
+		}
+		push, err = poker.NewPushItems(it).WithAction(poker.Dealt).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=conjure_card card=%s%s", ctx, req.Rank, req.Suit)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/logger"
+)
+
+// sseKeepAlivePeriod is how often comments are sent to keep SSE connections open through proxies
+const sseKeepAlivePeriod = 15 * time.Second
+
+// sseWriter writes pushes as Server-Sent Events
+type sseWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (w *sseWriter) WriteJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w.w, "data: %s\n\n", b); err != nil {
+		return err
+	}
+	w.f.Flush()
+	return nil
+}
+
+func (w *sseWriter) keepAlive() error {
+	if _, err := fmt.Fprint(w.w, ": ping\n\n"); err != nil {
+		return err
+	}
+	w.f.Flush()
+	return nil
+}
+
+// streamTableEvents is a fallback for clients that can't use web sockets:
+// the same pushes are streamed as Server-Sent Events
+func (s *server) streamTableEvents(w http.ResponseWriter, r *http.Request) {
+	httpx.H(s.authenticated(func(r *http.Request) (*httpx.Response, error) {
+		ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+		if err != nil {
+			return nil, errNoTable // bad ids and unknown tables look the same
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			return nil, errors.New("streaming is not supported")
+		}
+		updates, unsubscribe, err := subscribe(ctx, s.conf.updatesBuffer)
+		if err != nil {
+			return nil, err
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Accel-Buffering", "no") // disables nginx buffering
+		w.WriteHeader(http.StatusOK)
+		sw := &sseWriter{w: w, f: flusher}
+		flusher.Flush()
+		logger.Debug.Printf("sse %s pushes_start", ctx)
+		keepAlive := time.NewTicker(sseKeepAlivePeriod)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case update := <-updates:
+				if err := handlePush(ctx, sw, update); err != nil {
+					if errors.Is(err, errChanClosed) {
+						return nil, httpx.ErrFinished
+					}
+					logger.Error.Printf("sse %s %s", ctx, err)
+					unsubscribe()
+					return nil, httpx.ErrFinished
+				}
+			case <-keepAlive.C:
+				if err := sw.keepAlive(); err != nil {
+					logger.Error.Printf("sse %s keep_alive: %s", ctx, err)
+					unsubscribe()
+					return nil, httpx.ErrFinished
+				}
+			case <-r.Context().Done(): // the client is gone
+				unsubscribe()
+				return nil, httpx.ErrFinished
+			}
+		}
+	}))(w, r)
+}
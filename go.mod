@@ -2,10 +2,9 @@ module github.com/nchern/vpoker
 
 go 1.19
 
-require github.com/google/uuid v1.6.0
-
 require (
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/gorilla/schema v1.4.1 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/schema v1.4.1
+	github.com/gorilla/websocket v1.5.3
 )
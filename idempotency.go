@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	idempotencyTTL    = 5 * time.Minute
+
+	maxIdempotencyKeyLen = 128
+)
+
+// idempotentResult is an outcome of a request made with an idempotency key
+type idempotentResult struct {
+	done chan struct{}
+
+	resp *httpx.Response
+	err  error
+
+	expiresAt time.Time
+}
+
+// idempotencyCache keeps results of recent requests by (user, method, path, key)
+// so that retried requests are not applied twice
+type idempotencyCache struct {
+	lock    sync.Mutex
+	results map[string]*idempotentResult
+}
+
+func newIdempotencyCache() *idempotencyCache {
+	return &idempotencyCache{results: map[string]*idempotentResult{}}
+}
+
+// begin returns a result for a given key and whether the caller owns it,
+// i.e. has to run the request and finish the result
+func (c *idempotencyCache) begin(key string, now time.Time) (*idempotentResult, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for k, v := range c.results {
+		if now.After(v.expiresAt) {
+			delete(c.results, k)
+		}
+	}
+	if res, found := c.results[key]; found {
+		return res, false
+	}
+	res := &idempotentResult{done: make(chan struct{}), expiresAt: now.Add(idempotencyTTL)}
+	c.results[key] = res
+	return res, true
+}
+
+// finish records a result of a request. Failed requests are forgotten so that they can be retried
+func (c *idempotencyCache) finish(key string, res *idempotentResult, resp *httpx.Response, err error) {
+	c.lock.Lock()
+	res.resp, res.err = resp, err
+	if err != nil {
+		delete(c.results, key)
+	}
+	c.lock.Unlock()
+	close(res.done)
+}
+
+// idempotent makes a given mutating handler return the original response to
+// requests repeating an Idempotency-Key of the same user to the same endpoint
+// instead of applying them again
+func (s *server) idempotent(f httpx.RequestHandler) httpx.RequestHandler {
+	return func(r *http.Request) (*httpx.Response, error) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			return f(r)
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			return nil, httpx.NewError(http.StatusBadRequest, idempotencyHeader+" is too long")
+		}
+		sess, err := getUserFromSession(r, s.users)
+		if err != nil || sess.UserID == uuid.Nil {
+			return f(r)
+		}
+		// the same key sent to another endpoint is another request
+		cacheKey := sess.UserID.String() + " " + r.Method + " " + r.URL.Path + " " + key
+		res, owner := s.idempotency.begin(cacheKey, s.clock.Now())
+		if !owner {
+			<-res.done
+			return res.resp, res.err
+		}
+		resp, err := f(r)
+		s.idempotency.finish(cacheKey, res, resp, err)
+		return resp, err
+	}
+}
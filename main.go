@@ -1,11 +1,11 @@
 package main
 
 import (
-	"bufio"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"math/rand"
@@ -13,11 +13,10 @@ import (
 	"net/url"
 	"os"
 	"os/signal"
-	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"text/template"
 	"time"
@@ -39,16 +38,40 @@ const (
 	maxPlayers      = 3
 	cookieExpiresAt = 30 * 24 * time.Hour
 
+	// lastSeenThrottle limits how often User.LastSeenAt gets written
+	lastSeenThrottle = time.Minute
+
 	statePath = "/tmp/vpoker.json"
+
+	// defaultBankChips is a number of chips of each denomination in a new table bank
+	defaultBankChips = 50
+
+	saveStateEvery = 10 * time.Second
+)
+
+// Build info, injected via -ldflags at build time
+var (
+	version = "dev"
+	commit  = "unknown"
+
+	startedAt = time.Now()
 )
 
 var (
 	index      = template.Must(template.ParseFiles("web/index.html"))
 	pokerTable = template.Must(template.ParseFiles("web/poker.html"))
 	profile    = template.Must(template.ParseFiles("web/profile.html"))
+	errorPage  = template.Must(template.ParseFiles("web/error.html"))
 
 	errChanClosed = errors.New("channel closed")
 
+	errUnauthorized = httpx.NewError(http.StatusUnauthorized, http.StatusText(http.StatusUnauthorized))
+	// errNotMember is returned to users subscribing to updates of a table they have not joined
+	errNotMember = httpx.NewError(http.StatusForbidden, "you are not at the table: join it first to get its updates")
+
+	// errUserGone means a valid session refers to a user that no longer exists
+	errUserGone = httpx.NewError(http.StatusUnauthorized, "session user does not exist")
+
 	usernameValidator = regexp.MustCompile("(?i)^[a-z0-9_-]+?$")
 )
 
@@ -92,9 +115,34 @@ func (s *session) parseFromCookie(v string) error {
 	return nil
 }
 
-func randomString() string {
-	number := rand.Intn(10000) + 1
-	return strconv.Itoa(number)
+var (
+	nameAdjectives = []string{
+		"Brave", "Calm", "Clever", "Happy", "Lucky", "Mighty", "Quick", "Quiet",
+		"Sly", "Sneaky", "Bold", "Witty", "Jolly", "Gentle", "Fierce", "Shy",
+	}
+	nameAnimals = []string{
+		"Badger", "Bear", "Beaver", "Cat", "Crow", "Eagle", "Fox", "Hare",
+		"Heron", "Lynx", "Moose", "Otter", "Owl", "Panda", "Tiger", "Wolf",
+	}
+)
+
+// randomName generates a name from a given prefix, an adjective and an animal
+// that is not used yet by any known user
+func randomName(prefix string, users poker.UserMap) string {
+	taken := map[string]bool{}
+	users.Each(func(_ uuid.UUID, u *poker.User) bool {
+		taken[strings.ToLower(u.Name)] = true
+		return true
+	})
+	base := prefix +
+		nameAdjectives[rand.Intn(len(nameAdjectives))] +
+		nameAnimals[rand.Intn(len(nameAnimals))]
+	name := base
+	for i := 0; taken[strings.ToLower(name)]; i++ {
+		// the space grows with each attempt to keep collisions rare
+		name = base + strconv.Itoa(rand.Intn(100*(i+1)*(i+1)))
+	}
+	return name
 }
 
 func newSessionCookie(now time.Time, v string) *http.Cookie {
@@ -125,14 +173,15 @@ func newLastName(now time.Time, v string) *http.Cookie {
 }
 
 type Context struct {
-	ctx   context.Context
+	context.Context
+
 	table *poker.Table
 	user  *poker.User
 }
 
 func (c *Context) String() string {
-	fields := []string{fmt.Sprintf("request_id=%s", httpx.RequestID(c.ctx))}
-	fields = append(fields, fmt.Sprintf("client_ip=%s", c.ctx.Value(httpx.ClientIPKey)))
+	fields := []string{fmt.Sprintf("request_id=%s", httpx.RequestID(c))}
+	fields = append(fields, fmt.Sprintf("client_ip=%s", c.Value(httpx.ClientIPKey)))
 	if c.user != nil {
 		fields = append(fields, "user_name="+c.user.Name)
 	}
@@ -151,7 +200,7 @@ type contextBuilder struct {
 func newContextBuilder(ctx context.Context) *contextBuilder {
 	return &contextBuilder{
 		ctx: &Context{
-			ctx: ctx,
+			Context: ctx,
 		},
 	}
 }
@@ -170,13 +219,13 @@ func (b *contextBuilder) withTable(s *server, r *http.Request, idParam string) *
 	id := mux.Vars(r)[idParam]
 	tableID, err := uuid.Parse(id)
 	if err != nil {
-		logger.Error.Println("bad uuid=" + id)
-		b.err = httpx.NewError(http.StatusBadRequest, "bad id: "+id)
+		logger.Info.Printf("bad table id: %s", err)
+		b.err = errNoTable // never echo the input back
 		return b
 	}
 	table, found := s.tables.Get(tableID)
 	if !found {
-		b.err = httpx.NewError(http.StatusNotFound, "table not found")
+		b.err = errNoTable
 		return b
 	}
 	b.ctx.table = table
@@ -198,6 +247,9 @@ func (b *contextBuilder) withUser(s *server, r *http.Request) *contextBuilder {
 
 const retPathKey = "ret_path"
 
+// tableIDRoute matches table ids in routes: only the canonical lowercase uuid form
+const tableIDRoute = "{id:[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}}"
+
 func sanitizedRetpath(u *url.URL) string {
 	s := u.Query().Get(retPathKey)
 	if !strings.HasPrefix(s, "/") {
@@ -211,161 +263,392 @@ func sanitizedRetpath(u *url.URL) string {
 	return s
 }
 
-var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+func newUpgrader(conf config) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return true
+		},
+		// clients not offering the extension keep getting uncompressed messages
+		EnableCompression: conf.wsCompression,
+	}
 }
 
 type ItemUpdatedResponse struct {
 	Updated *poker.TableItem `json:"updated"`
 }
 
-type stateFile struct {
-	path string
-	lock sync.RWMutex
+// ConflictResponse is returned instead of a plain error when an item update
+// is rejected as stale: it carries the current state of the item so that
+// a client can reconcile without refetching the whole table
+type ConflictResponse struct {
+	Error     string           `json:"error"`
+	RequestID string           `json:"request_id"`
+	Version   int              `json:"version"`
+	Current   *poker.TableItem `json:"current"`
 }
 
-func NewStateFile(path string) *stateFile {
-	return &stateFile{path: path}
+// newConflictResponse makes a ConflictResponse out of an update error if it is a conflict on
+// an existing item, otherwise it returns nil. Must be called under the table lock
+func newConflictResponse(ctx *Context, id int, err error) *ConflictResponse {
+	var e *httpx.Error
+	if !errors.As(err, &e) || e.Code != http.StatusConflict {
+		return nil
+	}
+	it := ctx.table.Items.Get(id)
+	if it == nil {
+		return nil
+	}
+	cur := *it
+	cur.ApplyVisibilityRules(ctx.user)
+	return &ConflictResponse{
+		Error:     e.Message,
+		RequestID: httpx.RequestID(ctx),
+		Version:   ctx.table.Version,
+		Current:   &cur,
+	}
 }
 
-func (s *stateFile) save(marshalers ...json.Marshaler) error {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+// TableSummary is a short public description of a table
+type TableSummary struct {
+	ID         uuid.UUID `json:"id"`
+	Name       string    `json:"name"`
+	Players    int       `json:"players"`
+	Locked     bool      `json:"locked"`
+	SmallBlind int       `json:"small_blind"`
+	BigBlind   int       `json:"big_blind"`
+	MaxBet     int       `json:"max_bet"`
+
+	EmptySince *time.Time `json:"empty_since,omitempty"`
+}
 
-	f, err := os.Create(statePath)
-	defer func() { logError(f.Close(), "stateFile.save os.Create") }()
-	if err != nil {
-		return err
-	}
-	for _, v := range marshalers {
-		b, err := v.MarshalJSON()
-		if err != nil {
-			return err
-		}
-		if _, err := f.Write(b); err != nil {
-			return err
-		}
-		if _, err := fmt.Fprintln(f); err != nil {
-			return err
-		}
+func newTableSummary(t *poker.Table) *TableSummary {
+	return &TableSummary{
+		ID:         t.ID,
+		Name:       t.Name,
+		Players:    len(t.Players),
+		Locked:     t.Locked,
+		SmallBlind: t.SmallBlind,
+		BigBlind:   t.BigBlind,
+		MaxBet:     t.MaxBet,
+		EmptySince: t.EmptySince,
 	}
-	return err
 }
 
-func (s *stateFile) load(unmarshalers ...json.Unmarshaler) error {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
-	if err := os.MkdirAll(path.Dir(statePath), 0700); err != nil {
-		return err
+// queryInt parses an optional integer query parameter, missing ones are zeroes
+func queryInt(u *url.URL, name string) (int, error) {
+	v := u.Query().Get(name)
+	if v == "" {
+		return 0, nil
 	}
-	f, err := os.Open(statePath)
-	defer func() { logError(f.Close(), "stateFile.load os.Open") }()
+	n, err := strconv.Atoi(v)
 	if err != nil {
-		return err
+		return 0, httpx.NewError(http.StatusBadRequest, fmt.Sprintf("bad %s: %s", name, v))
 	}
-	r := bufio.NewReader(f)
-	for _, v := range unmarshalers {
-		l, err := r.ReadString('\n')
-		if err != nil {
-			return err
-		}
-		if err := v.UnmarshalJSON([]byte(l)); err != nil {
-			return err
-		}
-	}
-	return nil
+	return n, nil
+}
+
+type config struct {
+	// buyIn is an amount of chips each player gets on joining a new table
+	buyIn int
+
+	// maxBuyIn limits a single re-buy on new tables, zero means unlimited
+	maxBuyIn int
+
+	// provablyFair makes new tables commit to shuffle seeds and reveal them later
+	provablyFair bool
+
+	// stackedDeck makes new tables send the deck pile as a single item
+	stackedDeck bool
+
+	// privateStacks hides players stacks from opponents on new tables
+	privateStacks bool
+
+	// maxTables limits a total number of tables, zero means unlimited
+	maxTables int
+
+	// maxTablesPerUser limits a number of tables a user can create, zero means unlimited
+	maxTablesPerUser int
+
+	// tableTTL is how long a table is kept after all its players went inactive
+	tableTTL time.Duration
+
+	// anonPrefix is a name prefix of auto generated users
+	anonPrefix string
+
+	// statePath is a file where the state is persisted
+	statePath string
+
+	// wsPingPeriod is how often web socket clients are pinged: shorter periods keep
+	// connections alive through aggressive mobile NATs and detect dead clients sooner
+	// at the cost of more traffic and wakeups
+	wsPingPeriod time.Duration
+
+	// saveDelay enables saving the state this long after tables change, zero means interval saves only
+	saveDelay time.Duration
+
+	// wsCompression negotiates permessage-deflate with web socket clients supporting it
+	wsCompression bool
+
+	// idleKickAfter is how long a player can stay offline and idle before being removed, zero disables it
+	idleKickAfter time.Duration
+
+	// idleKickWarning is how long before removing an idle player the table gets warned
+	idleKickWarning time.Duration
+
+	// adminToken protects operator endpoints, empty disables them
+	adminToken string
+
+	// templatesPath is a JSON file with table templates, empty means built-in ones only
+	templatesPath string
+
+	// debug enables endpoints for tests and demos, never use it in production
+	debug bool
+
+	// maxCreatesPerMin limits tables a single user can create in a minute, zero means unlimited
+	maxCreatesPerMin int
+
+	// maxJoinsPerMin limits joins of a single user in a minute, zero means unlimited
+	maxJoinsPerMin int
+
+	// maxConnsPerUser limits web socket connections of a single user across all tables, zero means unlimited
+	maxConnsPerUser int
+
+	// updatesBuffer is a number of pushes buffered for each subscriber
+	updatesBuffer int
+
+	// noPersist runs the server in ephemeral mode keeping the state in memory only
+	noPersist bool
+
+	// userTTL is how long an inactive user who does not sit at any table is kept
+	userTTL time.Duration
+
+	// anonTTL is how long an inactive user with an auto generated name who does not sit at any table is kept
+	anonTTL time.Duration
+
+	// allowAnonCreate lets users who have not chosen a name yet create tables
+	allowAnonCreate bool
 }
 
 type server struct {
 	endpoint string
 
+	conf config
+
 	tables poker.TableMap
 	users  poker.UserMap
 
-	state *stateFile
+	state Store
+
+	idempotency *idempotencyCache
+
+	conns    *connTracker
+	upgrader *websocket.Upgrader
+
+	createLimit *rateLimiter
+	joinLimit   *rateLimiter
+
+	// clock tells the time to handlers and background loops
+	clock poker.Clock
+
+	// dirty gets signalled after successful table updates, see markDirty
+	dirty chan struct{}
+}
+
+// minGzipPushSize is a size of a push starting from which it gets compressed
+const minGzipPushSize = 1024
+
+// pushWriter writes pushes to a web socket connection
+type pushWriter struct {
+	conn *websocket.Conn
+
+	// gzip enables compression of big pushes, they are sent as binary messages
+	gzip bool
+}
+
+func (w *pushWriter) WriteJSON(v any) error {
+	if !w.gzip {
+		return w.conn.WriteJSON(v)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(b) < minGzipPushSize {
+		return w.conn.WriteMessage(websocket.TextMessage, b)
+	}
+	if b, err = httpx.Gzip(b); err != nil {
+		return err
+	}
+	return w.conn.WriteMessage(websocket.BinaryMessage, b)
+}
+
+// jsonWriter writes pushes to a client connection
+type jsonWriter interface {
+	WriteJSON(v any) error
+}
+
+// subscribe subscribes the current player to table updates.
+// Returned unsubscribe func must be called once the client is gone
+func subscribe(ctx *Context, bufSize int) (chan *poker.Push, func(), error) {
+	updates := poker.NewUpdates(bufSize)
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return errNotMember // tells a client why it gets no updates
+		}
+		t.Players[ctx.user.ID].Subscribe(updates)
+		return nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	unsubscribe := func() {
+		// the request may be over by now, yet the cleanup has to happen anyway
+		logError(ctx.table.Update(context.Background(), func(t *poker.Table) error {
+			if p := t.Players[ctx.user.ID]; p != nil {
+				p.UnsubscribeFrom(updates)
+			}
+			return nil
+		}), "unsubscribe")
+		logger.Info.Printf("%s pushes_finish", ctx)
+	}
+	return updates, unsubscribe, nil
 }
 
-func handlePush(ctx *Context, conn *websocket.Conn, update *poker.Push) error {
-	if update == nil {
-		// channel closed, teminating this update loop
-		msg := "terminated by another connection"
-		logger.Info.Printf("ws %s web socket connection %s", ctx, msg)
-		if err := conn.WriteJSON(poker.NewPushDisconnected()); err != nil {
+func handlePush(ctx *Context, conn jsonWriter, update *poker.Push) error {
+	if update == nil || update.Type == poker.Disconnected {
+		// channel closed, teminating this update loop. The reason is unknown
+		// if it could not be sent before the channel got closed
+		if update == nil {
+			update = poker.NewPushDisconnected("")
+		}
+		logger.Info.Printf("ws %s web socket connection terminated: reason=%s", ctx, update.Reason)
+		if err := conn.WriteJSON(update); err != nil {
 			logger.Error.Printf("%s conn.WriteMessage %s", ctx, err)
 		}
 		return errChanClosed
 	}
-	logger.Debug.Printf("ws %s push_begin: %s", ctx, update.Type)
+	logger.Debug.Printf("ws %s push_begin: %s origin_request_id=%s", ctx, update.Type, update.RequestID())
 	resp, err := update.DeepCopy()
 	if err != nil {
 		return err
 	}
-	for _, it := range resp.Items {
-		it.ApplyVisibilityRules(ctx.user)
-	}
+	resp.ApplyVisibilityRules(ctx.user)
 	if err := conn.WriteJSON(resp); err != nil {
 		return fmt.Errorf("conn.WriteJSON: %w", err)
 	}
-	logger.Debug.Printf("%s push_finished: %s", ctx, update.Type)
+	logger.Debug.Printf("%s push_finished: %s origin_request_id=%s", ctx, update.Type, update.RequestID())
 	return nil
 }
 
+const (
+	// defaultWSPingPeriod is how often pings are sent to web socket clients by default
+	defaultWSPingPeriod = 15 * time.Second
+	// minWSPingPeriod protects from busy ping loops
+	minWSPingPeriod = time.Second
+	// wsPongWaitPings is a number of ping periods to wait for a pong before the connection is considered dead
+	wsPongWaitPings = 4
+	// wsWriteWait is a time allowed to write a control message
+	wsWriteWait = 10 * time.Second
+)
+
+// readPump reads a web socket connection so that control messages(pongs) get processed.
+// The returned channel gets closed once the connection is dead
+func readPump(ctx *Context, conn *websocket.Conn, pongWait time.Duration) <-chan struct{} {
+	dead := make(chan struct{})
+	extend := func(string) error { return conn.SetReadDeadline(time.Now().Add(pongWait)) }
+	logError(extend(""), "conn.SetReadDeadline")
+	conn.SetPongHandler(extend)
+	go func() {
+		defer close(dead)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				logger.Info.Printf("ws %s read_finish: %s", ctx, err)
+				return
+			}
+		}
+	}()
+	return dead
+}
+
+// servePushes upgrades a given request to a web socket and sends pushes from updates to it
+// until the channel gets closed or the client disconnects
+func (s *server) servePushes(
+	ctx *Context,
+	w http.ResponseWriter,
+	r *http.Request,
+	updates chan *poker.Push,
+	unsubscribe func()) (*httpx.Response, error) {
+
+	hdrs := http.Header{}
+	hdrs.Set(httpx.RequestHeaderName, httpx.RequestID(ctx))
+	conn, err := s.upgrader.Upgrade(w, r, hdrs) // after .Upgrade normal http responses are not posible
+	if err != nil {
+		unsubscribe()
+		return nil, fmt.Errorf("upgrader.Upgrade: %w", err)
+	}
+	defer conn.Close()
+	if ctx.user.ID != uuid.Nil { // anonymous spectators are not tracked
+		release := s.conns.add(ctx.user.ID, conn)
+		defer release()
+	}
+	pw := &pushWriter{conn: conn, gzip: r.URL.Query().Get("encoding") == "gzip"}
+	logger.Debug.Printf("ws %s pushes_start", ctx)
+	dead := readPump(ctx, conn, wsPongWaitPings*s.conf.wsPingPeriod)
+	ping := time.NewTicker(s.conf.wsPingPeriod)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case update := <-updates:
+			if err = handlePush(ctx, pw, update); err != nil {
+				if errors.Is(err, errChanClosed) {
+					return nil, httpx.ErrFinished // terminate the loop only if channel got closed
+				}
+				logger.Error.Printf("ws %s %s", ctx, err)
+			}
+		case <-ping.C: // check state periodically
+			deadline := time.Now().Add(wsWriteWait)
+			if err = conn.WriteControl(websocket.PingMessage, []byte("ping"), deadline); err != nil {
+				logger.Error.Printf("ws %s websocket_ping: %s", ctx, err)
+				unsubscribe()
+				return nil, httpx.ErrFinished // unable to write - close this connection
+			}
+		case <-dead: // no pongs or reads failed: the client is gone
+			unsubscribe()
+			return nil, httpx.ErrFinished
+		}
+		if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
+			unsubscribe()
+			return nil, httpx.ErrFinished // terminate the loop
+		}
+	}
+}
+
 func (s *server) pushTableUpdates(w http.ResponseWriter, r *http.Request) {
 	// Pushes loop gets terminated in the following cases:
 	// - disconnections from the client
 	// - channel externally closed - a new web socket connection by the same player
-	httpx.H(authenticated(s.users, func(r *http.Request) (*httpx.Response, error) {
+	httpx.H(s.authenticated(func(r *http.Request) (*httpx.Response, error) {
 		ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 		if err != nil {
-			return nil, err
+			return nil, errNoTable // bad ids and unknown tables look the same
 		}
-		var p *poker.Player
-		updates := make(chan *poker.Push)
-		if err := ctx.table.Update(func(t *poker.Table) error {
-			p = t.Players[ctx.user.ID]
-			if p == nil {
-				return httpx.NewError(http.StatusForbidden, "you are not at the table")
-			}
-			p.Subscribe(updates)
-			return nil
-		}); err != nil {
-			return nil, err
+		if !websocket.IsWebSocketUpgrade(r) {
+			// a browser navigated here: send it to the table page which handles joining
+			return httpx.Redirect(fmt.Sprintf("/games/%s", ctx.table.ID)), nil
 		}
-		hdrs := http.Header{}
-		hdrs.Set(httpx.RequestHeaderName, httpx.RequestID(ctx.ctx))
-		conn, err := upgrader.Upgrade(w, r, hdrs) // after .Upgrade normal http responses are not posible
+		updates, unsubscribe, err := subscribe(ctx, s.conf.updatesBuffer)
 		if err != nil {
-			return nil, fmt.Errorf("upgrader.Upgrade: %w", err)
+			return nil, err
 		}
-		defer conn.Close()
-		logger.Debug.Printf("ws %s pushes_start", ctx)
-		for {
-			var err error
+		if r.URL.Query().Get("reconnect") != "" {
+			// the client may have missed pushes, e.g. during a restart: make it reload the state.
+			// Players are kept in the state, so reconnecting re-seats them
 			select {
-			case update := <-updates:
-				if err = handlePush(ctx, conn, update); err != nil {
-					if errors.Is(err, errChanClosed) {
-						return nil, httpx.ErrFinished // terminate the loop only if channel got closed
-					}
-					logger.Error.Printf("ws %s %s", ctx, err)
-				}
-			case <-time.After(15 * time.Second): // check state periodically
-				if err = conn.WriteMessage(websocket.PingMessage, []byte("ping")); err != nil {
-					logger.Error.Printf("ws %s %s", ctx, err)
-					// decide how to unsubscribe - race conditions
-					// unable to write - close this connection
-					// return nil, fmt.Errorf("websocket_ping write error: %w", err)
-				}
-				// no need to read - browser does not automatically send a response
-			}
-			if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) {
-				close(updates)
-				logger.Info.Printf("ws %s pushes_finish", ctx)
-				return nil, httpx.ErrFinished // terminate the loop
+			case updates <- poker.NewPushRefresh():
+			default:
 			}
 		}
+		return s.servePushes(ctx, w, r, updates, unsubscribe)
 	}))(w, r)
 }
 
@@ -374,44 +657,62 @@ func (s *server) shuffle(r *http.Request) (*httpx.Response, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := ctx.table.Update(func(t *poker.Table) error {
-		if t.Players[ctx.user.ID] == nil {
-			return httpx.NewError(http.StatusForbidden, "you are not at the table")
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
 		}
-		ctx.table.Shuffle()
+		t.ShuffleBy(ctx.user, s.clock.Now())
 		return nil
 	}); err != nil {
 		return nil, err
 	}
 	// notify others
 	// push updates: potentially long operation - check
-	ctx.table.NotifyOthers(ctx.user, poker.NewPushRefresh())
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushRefresh())
 	return httpx.Redirect(fmt.Sprintf("/games/%s", ctx.table.ID)), nil
 }
 
+func (s *server) undoShuffle(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		return t.UndoShuffle(ctx.user)
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=undo_shuffle", ctx)
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushRefresh())
+	return httpx.JSON(http.StatusOK, m{}), nil
+}
+
 func (s *server) showCard(r *http.Request) (*httpx.Response, error) {
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	req := map[string]int{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var req itemRequest
+	if err := decodeStrict(r, &req); err != nil {
 		return nil, err
 	}
-	id, found := req["id"]
-	if !found {
-		return nil, httpx.NewError(http.StatusBadRequest, "id field is missing")
+	id, err := req.id()
+	if err != nil {
+		return nil, err
 	}
 	var updated poker.TableItem
-	if err := ctx.table.Update(func(t *poker.Table) error {
-		if t.Players[ctx.user.ID] == nil {
-			return httpx.NewError(http.StatusForbidden, "you are not at the table")
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
 		}
 		item := t.Items.Get(id)
 		if item == nil {
 			return httpx.NewError(http.StatusNotFound, "item not found")
 		}
-		if err := item.Show(ctx.user); err != nil {
+		if err := item.Show(ctx.user, s.clock.Now()); err != nil {
 			return err
 		}
 		updated = *item
@@ -420,273 +721,1564 @@ func (s *server) showCard(r *http.Request) (*httpx.Response, error) {
 		return nil, err
 	}
 	// push updates: potentially long operation - check
-	ctx.table.NotifyOthers(ctx.user, poker.NewPushItems(&updated))
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushItems(&updated).WithAction(poker.Shown))
 	return httpx.JSON(http.StatusOK, &ItemUpdatedResponse{Updated: &updated}), nil
 }
 
-func (s *server) giveCard(r *http.Request) (*httpx.Response, error) {
-	type form struct {
-		ID     int       `schema:"id,reqiured"`
-		UserID uuid.UUID `schema:"user_id,reqiured"`
-	}
+func (s *server) unrevealCard(r *http.Request) (*httpx.Response, error) {
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	var frm form
-	if err := r.ParseForm(); err != nil {
+	var req itemRequest
+	if err := decodeStrict(r, &req); err != nil {
 		return nil, err
 	}
-	var decoder = schema.NewDecoder()
-	if err := decoder.Decode(&frm, r.Form); err != nil {
-		logger.Error.Printf("%s bad_form: %s", ctx, err)
-		return nil, httpx.NewError(http.StatusBadRequest, "bad params: "+err.Error())
+	id, err := req.id()
+	if err != nil {
+		return nil, err
 	}
 	var updated poker.TableItem
-	if err := ctx.table.Update(func(t *poker.Table) error {
-		if t.Players[ctx.user.ID] == nil {
-			return httpx.NewError(http.StatusForbidden, "you are not at the table")
-		}
-		recepient := t.Players[frm.UserID]
-		if recepient == nil {
-			return httpx.NewError(http.StatusForbidden, "recepient is not at the table")
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
 		}
-		item := t.Items.Get(int(frm.ID))
+		item := t.Items.Get(id)
 		if item == nil {
 			return httpx.NewError(http.StatusNotFound, "item not found")
 		}
-		updated = *item.Take(recepient.User)
+		if err := item.Unreveal(ctx.user, s.clock.Now()); err != nil {
+			return err
+		}
+		updated = *item
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	updated.Side = poker.Cover
-	ctx.table.NotifyOthers(ctx.user, poker.NewPushItems(&updated))
-	return httpx.JSON(http.StatusOK, ItemUpdatedResponse{Updated: &updated}), nil
+	push := poker.NewPushItems(&updated).WithAction(poker.Covered)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return httpx.JSON(http.StatusOK, &ItemUpdatedResponse{Updated: &updated}), nil
 }
 
-func (s *server) takeCard(r *http.Request) (*httpx.Response, error) {
+func (s *server) grabItem(r *http.Request) (*httpx.Response, error) {
+	return s.handleGrab(r, (*poker.TableItem).Grab)
+}
+
+func (s *server) releaseItem(r *http.Request) (*httpx.Response, error) {
+	return s.handleGrab(r, (*poker.TableItem).Release)
+}
+
+func (s *server) handleGrab(
+	r *http.Request,
+	action func(*poker.TableItem, *poker.User, time.Time) error) (*httpx.Response, error) {
+
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	req := map[string]int{}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	var req itemRequest
+	if err := decodeStrict(r, &req); err != nil {
 		return nil, err
 	}
-	id, found := req["id"]
-	if !found {
-		return nil, httpx.NewError(http.StatusBadRequest, "id field is missing")
+	id, err := req.id()
+	if err != nil {
+		return nil, err
 	}
 	var updated poker.TableItem
-	if err := ctx.table.Update(func(t *poker.Table) error {
-		if t.Players[ctx.user.ID] == nil {
-			return httpx.NewError(http.StatusForbidden, "you are not at the table")
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
 		}
 		item := t.Items.Get(id)
 		if item == nil {
 			return httpx.NewError(http.StatusNotFound, "item not found")
 		}
-		updated = *item.Take(ctx.user)
+		if err := action(item, ctx.user, s.clock.Now()); err != nil {
+			return err
+		}
+		if item.GrabbedBy != "" {
+			t.BringToTop(item)
+		}
+		updated = *item
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	updated.Side = poker.Face
-	// push updates: potentially long operation - check
-	ctx.table.NotifyOthers(ctx.user, poker.NewPushItems(&updated))
-	return httpx.JSON(http.StatusOK, ItemUpdatedResponse{Updated: &updated}), nil
+	push := poker.NewPushItems(&updated)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
 }
 
-func (s *server) profile(r *http.Request) (*httpx.Response, error) {
-	sess, err := getUserFromSession(r, s.users)
+func (s *server) bet(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	return httpx.RenderFile(http.StatusOK, "web/profile.html", m{
-		"Retpath":  sanitizedRetpath(r.URL),
-		"Username": sess.user.Name,
-	})
-}
-
-func (s *server) updateProfile(r *http.Request) (*httpx.Response, error) {
-	if err := r.ParseForm(); err != nil {
-		return nil, err
-	}
-	sess, err := getUserFromSession(r, s.users)
-	if err != nil {
+	req := map[string]int{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		return nil, err
 	}
-	name := strings.TrimSpace(r.FormValue("user_name"))
-	if !usernameValidator.MatchString(name) {
-		return httpx.String(http.StatusBadRequest, "invalid characters in user name"), nil
+	amount, found := req["amount"]
+	if !found {
+		return nil, httpx.NewError(http.StatusBadRequest, "amount field is missing")
 	}
-	if err := s.users.Update(sess.user.ID, func(u *poker.User) error {
-		u.Name = name
-		sess.user = u
+	var economy *poker.Economy
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		if err := t.Bet(p, amount); err != nil {
+			return err
+		}
+		economy = t.Economy()
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	lastNameCookie := newLastName(time.Now(), name)
-	if retPath := sanitizedRetpath(r.URL); retPath != "" {
-		return httpx.Redirect(retPath).SetCookie(lastNameCookie), nil
-	}
-	return httpx.Render(
-		http.StatusOK,
-		profile,
-		m{"Username": sess.user.Name},
-		lastNameCookie)
+	push := poker.NewPushEconomy(economy)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
 }
 
-func updateItem(ctx *Context, r *http.Request) (*poker.TableItem, error) {
-	curUser, table := ctx.user, ctx.table
-	if table.Players[curUser.ID] == nil {
-		return nil, httpx.NewError(http.StatusForbidden, "you are not at the table")
-	}
-	b, err := io.ReadAll(r.Body)
+func (s *server) newHand(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	logger.Debug.Printf("%s update: %s", ctx, string(b))
-	var src poker.TableItem
-	if err := json.Unmarshal(b, &src); err != nil {
+	req := struct {
+		WinnerID *uuid.UUID `json:"winner_id"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, httpx.NewError(http.StatusBadRequest, "bad request: "+err.Error())
+	}
+	var economy *poker.Economy
+	var players *poker.Push
+	var cards []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		var winner *poker.Player
+		if req.WinnerID != nil {
+			if winner = t.Players[*req.WinnerID]; winner == nil {
+				return httpx.NewError(http.StatusBadRequest, "winner is not at the table")
+			}
+		}
+		cards = t.CompactItems(t.NewHand(winner).Copy())
+		economy = t.Economy()
+		players, err = poker.NewPushPlayers(t.Players).DeepCopy() // fold marks are reset
+		return err
+	}); err != nil {
 		return nil, err
 	}
-	dest := table.Items.Get(src.ID)
-	if dest == nil {
-		return nil, httpx.NewError(http.StatusNotFound, "item not found")
-	}
-	if err := dest.UpdateFrom(curUser, &src); err != nil {
-		return nil, httpx.NewError(http.StatusBadRequest, err.Error())
-	}
-	return dest, nil
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushItems(cards...))
+	ctx.table.NotifyOthers(ctx, ctx.user, players)
+	push := poker.NewPushEconomy(economy)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
 }
 
-func (s *server) updateTable(r *http.Request) (*httpx.Response, error) {
+func (s *server) rebuy(r *http.Request) (*httpx.Response, error) {
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	curUser, table := ctx.user, ctx.table
-	var updated poker.TableItem
-	if err := table.Update(func(t *poker.Table) error {
-		up, err := updateItem(ctx, r)
+	req := map[string]int{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	amount, found := req["amount"]
+	if !found {
+		return nil, httpx.NewError(http.StatusBadRequest, "amount field is missing")
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		items, err := t.Rebuy(p, amount)
 		if err != nil {
 			return err
 		}
-		updated = *up
-		return nil
+		push = poker.NewPushItems(items...)
+		push.Economy = t.Economy()
+		// copy while under the lock, the push is read by other goroutines
+		push, err = push.DeepCopy()
+		return err
 	}); err != nil {
 		return nil, err
 	}
-	logger.Debug.Printf("%s update dest=%+v", ctx, updated)
-	// push updates: potentially long operation - check
-	ctx.table.NotifyOthers(curUser, poker.NewPushItems(&updated))
-	return httpx.JSON(http.StatusOK, ItemUpdatedResponse{Updated: &updated}), nil
+	logger.Info.Printf("%s action=rebuy amount=%d", ctx, amount)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
 }
 
-func (s *server) joinTable(r *http.Request) (*httpx.Response, error) {
+func (s *server) hideStack(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]bool{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	hide, found := req["hide"]
+	if !found {
+		return nil, httpx.NewError(http.StatusBadRequest, "hide field is missing")
+	}
+	var economy *poker.Economy
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		p.HideStack = hide
+		economy = t.Economy()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	push := poker.NewPushEconomy(economy)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) nickname(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(req["name"])
+	if name != "" && !usernameValidator.MatchString(name) {
+		return nil, httpx.NewError(http.StatusBadRequest, "invalid characters in user name")
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		p.DisplayName = name
+		push, err = poker.NewPushPlayers(t.Players).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) recolor(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return nil, err
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		if err := t.Recolor(t.Players[ctx.user.ID], poker.Color(req["color"])); err != nil {
+			return err
+		}
+		push, err = poker.NewPushPlayers(t.Players).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) cardBack(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	back := req["card_back"]
+	if !poker.IsCardBack(back) {
+		return nil, httpx.NewError(http.StatusBadRequest, "unknown card back: "+back)
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		p.CardBack = back
+		push, err = poker.NewPushPlayers(t.Players).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+// pushResponse returns a given push as a response for the current user
+func pushResponse(curUser *poker.User, push *poker.Push) (*httpx.Response, error) {
+	resp, err := push.DeepCopy()
+	if err != nil {
+		return nil, err
+	}
+	resp.ApplyVisibilityRules(curUser)
+	return httpx.JSON(http.StatusOK, resp), nil
+}
+
+func (s *server) deal(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	req := struct {
+		Pattern poker.DealPattern `json:"pattern"`
+		Count   int               `json:"count"`
+	}{Pattern: poker.OneByOne}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, httpx.NewError(http.StatusBadRequest, "bad request: "+err.Error())
+	}
+	var dealt []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		items, err := t.Deal(req.Pattern, req.Count)
+		if err != nil {
+			return err
+		}
+		dealt = t.CompactItems(items.Copy())
+		t.LastDealtBy = ctx.user.ID
+		t.LastDealtAt = t.Now()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=deal pattern=%s count=%d", ctx, req.Pattern, req.Count)
+	push := poker.NewPushItems(dealt...).WithAction(poker.Dealt)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) coverAll(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var covered []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		covered = t.CoverAll().Copy()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=cover_all covered=%d", ctx, len(covered))
+	push := poker.NewPushItems(covered...).WithAction(poker.Covered)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) clearBoard(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var gathered []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		gathered = t.CompactItems(t.ClearBoard().Copy())
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=clear_board gathered=%d", ctx, len(gathered))
+	push := poker.NewPushItems(gathered...).WithAction(poker.Covered)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) deckAudit(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var audit *poker.DeckAudit
+	if err := ctx.table.ReadLock(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		audit = t.AuditDeck()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	if !audit.OK {
+		logger.Error.Printf("%s deck_audit failed: %+v", ctx, audit)
+	}
+	return httpx.JSON(http.StatusOK, audit), nil
+}
+
+// showToRequest refers to a card to reveal to given players
+type showToRequest struct {
+	itemRequest
+
+	UserIDs []uuid.UUID `json:"user_ids"`
+}
+
+func (s *server) showTo(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req showToRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	id, err := req.id()
+	if err != nil {
+		return nil, err
+	}
+	if len(req.UserIDs) == 0 {
+		return nil, httpx.NewError(http.StatusBadRequest, "user_ids field is missing")
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		for _, uid := range req.UserIDs {
+			if uid == ctx.user.ID || t.Players[uid] == nil {
+				return httpx.NewError(http.StatusBadRequest, "not a player to show to: "+uid.String())
+			}
+		}
+		item := t.Items.Get(id)
+		if item == nil {
+			return httpx.NewError(http.StatusNotFound, "item not found")
+		}
+		if err := item.ShowTo(ctx.user, req.UserIDs); err != nil {
+			return err
+		}
+		push, err = poker.NewPushItems(item).WithAction(poker.Shown).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=show_to id=%d targets=%d", ctx, id, len(req.UserIDs))
+	// the card stays covered for the table, only the targets see it
+	ctx.table.NotifyPlayers(ctx, req.UserIDs, push)
+	return pushResponse(ctx.user, push)
+}
+
+// flipMineRequest is a side to turn all own cards to
+type flipMineRequest struct {
+	Side poker.Side `json:"side"`
+}
+
+func (s *server) flipMine(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req flipMineRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	if !req.Side.IsValid() {
+		return nil, httpx.NewError(http.StatusBadRequest, "bad side: "+string(req.Side))
+	}
+	var flipped []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		flipped = t.FlipOwned(ctx.user, req.Side).Copy()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=flip_mine side=%s flipped=%d", ctx, req.Side, len(flipped))
+	push := poker.NewPushItems(flipped...).WithAction(poker.Flipped)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) result(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var res *poker.Result
+	if err := ctx.table.ReadLock(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		res = t.Result()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return httpx.JSON(http.StatusOK, res), nil
+}
+
+func (s *server) fold(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		p := t.Players[ctx.user.ID]
+		push, err = poker.NewPushPlayerFolded(t.Players, t.Fold(p)...).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=fold", ctx)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) moveDeck(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	req := map[string]int{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	var moved []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		items, err := t.MoveDeck(req["dx"], req["dy"])
+		if err != nil {
+			return err
+		}
+		moved = t.CompactItems(items.Copy())
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	push := poker.NewPushItems(moved...).WithAction(poker.Moved)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) giveCard(r *http.Request) (*httpx.Response, error) {
+	type form struct {
+		ID     int       `schema:"id,reqiured"`
+		UserID uuid.UUID `schema:"user_id,reqiured"`
+	}
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var frm form
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	var decoder = schema.NewDecoder()
+	if err := decoder.Decode(&frm, r.Form); err != nil {
+		logger.Error.Printf("%s bad_form: %s", ctx, err)
+		return nil, httpx.NewError(http.StatusBadRequest, "bad params: "+err.Error())
+	}
+	var updated poker.TableItem
+	var pushed []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		recepient := t.Players[frm.UserID]
+		if recepient == nil {
+			return httpx.NewError(http.StatusForbidden, "recepient is not at the table")
+		}
+		item, err := s.takeItem(t, frm.ID, ctx.user, recepient)
+		if err != nil {
+			return err
+		}
+		updated = *item
+		pushed = t.CompactItems([]*poker.TableItem{&updated})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushItems(pushed...).WithAction(poker.Taken))
+	resp := updated
+	resp.ApplyVisibilityRules(ctx.user) // the giver no longer sees the card
+	return httpx.JSON(http.StatusOK, ItemUpdatedResponse{Updated: &resp}), nil
+}
+
+func (s *server) passCard(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		itemRequest
+		UserID uuid.UUID `json:"user_id"`
+	}
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	id, err := req.id()
+	if err != nil {
+		return nil, err
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		from := t.Players[ctx.user.ID]
+		to := t.Players[req.UserID]
+		if to == nil {
+			return httpx.NewError(http.StatusBadRequest, "recepient is not at the table")
+		}
+		item := t.Items.Get(id)
+		if item == nil {
+			return httpx.NewError(http.StatusNotFound, "item not found")
+		}
+		if err := item.CheckGrab(ctx.user, s.clock.Now()); err != nil {
+			return err
+		}
+		if err := t.PassCard(item, from, to); err != nil {
+			return err
+		}
+		push, err = poker.NewPushItems(item).WithAction(poker.Passed).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=pass_card id=%d to=%s", ctx, id, req.UserID)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) burn(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		it, err := t.Burn()
+		if err != nil {
+			return err
+		}
+		push, err = poker.NewPushItems(t.CompactItems(poker.TableItemList{it}.Copy())...).
+			WithAction(poker.Burned).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=burn", ctx)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+func (s *server) returnCard(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req itemRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	id, err := req.id()
+	if err != nil {
+		return nil, err
+	}
+	var push *poker.Push
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		item := t.Items.Get(id)
+		if item == nil {
+			return httpx.NewError(http.StatusNotFound, "item not found")
+		}
+		if !item.Is(poker.CardClass) || !item.IsOwnedBy(ctx.user.ID) {
+			return httpx.NewError(http.StatusForbidden, "you do not own this card")
+		}
+		push, err = poker.NewPushItems(t.MuckCard(item)).WithAction(poker.Mucked).DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=return_card id=%d", ctx, id)
+	ctx.table.NotifyOthers(ctx, ctx.user, push)
+	return pushResponse(ctx.user, push)
+}
+
+// takeItem hands the item id over to the player p on behalf of the user by,
+// who is p's user when taking and the giver when giving a card
+func (s *server) takeItem(t *poker.Table, id int, by *poker.User, p *poker.Player) (*poker.TableItem, error) {
+	item := t.Items.Get(id)
+	if id == poker.DeckItemID {
+		item = t.DeckTop() // stacked deck: take the top card
+	}
+	if item == nil {
+		return nil, httpx.NewError(http.StatusNotFound, "item not found")
+	}
+	if err := item.CheckGrab(by, s.clock.Now()); err != nil {
+		return nil, err
+	}
+	if item.Burned {
+		return nil, httpx.NewError(http.StatusConflict, "burned cards can not be taken")
+	}
+	if item.Mucked {
+		return nil, httpx.NewError(http.StatusConflict, "mucked cards can not be taken")
+	}
+	if item.Is(poker.CardClass) && !item.IsOwned() {
+		if err := t.CheckHand(p, 1); err != nil {
+			return nil, err
+		}
+	}
+	return item.Take(p.User), nil
+}
+
+func (s *server) takeCard(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req itemRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	id, err := req.id()
+	if err != nil {
+		return nil, err
+	}
+	var updated poker.TableItem
+	var pushed []*poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		item, err := s.takeItem(t, id, ctx.user, t.Players[ctx.user.ID])
+		if err != nil {
+			return err
+		}
+		updated = *item
+		pushed = t.CompactItems([]*poker.TableItem{&updated})
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// push updates: potentially long operation - check
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushItems(pushed...).WithAction(poker.Taken))
+	resp := updated
+	resp.ApplyVisibilityRules(ctx.user) // the taker sees the card unless someone else owns it
+	return httpx.JSON(http.StatusOK, ItemUpdatedResponse{Updated: &resp}), nil
+}
+
+func (s *server) profile(r *http.Request) (*httpx.Response, error) {
+	sess, err := getUserFromSession(r, s.users)
+	if err != nil {
+		return nil, err
+	}
+	return httpx.RenderFile(http.StatusOK, "web/profile.html", m{
+		"Retpath":  sanitizedRetpath(r.URL),
+		"Username": sess.user.Name,
+	})
+}
+
+func (s *server) updateProfile(r *http.Request) (*httpx.Response, error) {
+	if err := r.ParseForm(); err != nil {
+		return nil, err
+	}
+	sess, err := getUserFromSession(r, s.users)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(r.FormValue("user_name"))
+	if !usernameValidator.MatchString(name) {
+		return nil, httpx.NewError(http.StatusBadRequest, "invalid characters in user name")
+	}
+	if err := s.users.Update(sess.user.ID, func(u *poker.User) error {
+		u.Name = name
+		u.Anonymous = false
+		sess.user = u
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	lastNameCookie := newLastName(s.clock.Now(), name)
+	if retPath := sanitizedRetpath(r.URL); retPath != "" {
+		return httpx.Redirect(retPath).SetCookie(lastNameCookie), nil
+	}
+	return httpx.Render(
+		http.StatusOK,
+		profile,
+		m{"Username": sess.user.Name},
+		lastNameCookie)
+}
+
+// decodeStrict decodes a JSON request body rejecting unknown fields
+func decodeStrict(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return httpx.NewError(http.StatusBadRequest, "bad request: "+err.Error())
+	}
+	return nil
+}
+
+// itemRequest refers to a single table item
+type itemRequest struct {
+	ID *int `json:"id"`
+}
+
+func (ir *itemRequest) id() (int, error) {
+	if ir.ID == nil {
+		return 0, httpx.NewError(http.StatusBadRequest, "id field is missing")
+	}
+	return *ir.ID, nil
+}
+
+// itemUpdateRequest is an item as a client sees it: only position and side
+// can change, the rest must match the server state
+type itemUpdateRequest struct {
+	poker.Card
+	poker.Chip
+
+	ID          int         `json:"id"`
+	Class       poker.Class `json:"class"`
+	OwnerID     string      `json:"owner_id"`
+	PrevOwnerID string      `json:"prev_owner_id"`
+	X           int         `json:"x"`
+	Y           int         `json:"y"`
+	ZIndex      int         `json:"z_index"`
+}
+
+func (ur *itemUpdateRequest) toItem() *poker.TableItem {
+	return &poker.TableItem{
+		Card:        ur.Card,
+		Chip:        ur.Chip,
+		ID:          ur.ID,
+		Class:       ur.Class,
+		OwnerID:     ur.OwnerID,
+		PrevOwnerID: ur.PrevOwnerID,
+		X:           ur.X,
+		Y:           ur.Y,
+		ZIndex:      ur.ZIndex,
+	}
+}
+
+func updateItem(ctx *Context, req *itemUpdateRequest) (*poker.TableItem, poker.ItemAction, error) {
+	curUser, table := ctx.user, ctx.table
+	if err := table.RequireMember(curUser.ID); err != nil {
+		return nil, "", err
+	}
+	logger.Debug.Printf("%s update: %+v", ctx, req)
+	src := req.toItem()
+	dest := table.Items.Get(src.ID)
+	if dest == nil {
+		return nil, "", httpx.NewError(http.StatusNotFound, "item not found")
+	}
+	if err := dest.CheckGrab(curUser, table.Now()); err != nil {
+		return nil, "", err
+	}
+	moved := dest.X != src.X || dest.Y != src.Y
+	side := dest.Side
+	if err := dest.UpdateFrom(curUser, src); err != nil {
+		return nil, "", err
+	}
+	table.Clamp(dest)
+	action := poker.Moved
+	if dest.Side != side {
+		action = poker.Flipped
+	}
+	if moved {
+		table.BringToTop(dest)
+	}
+	return dest, action, nil
+}
+
+func (s *server) updateTable(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	curUser, table := ctx.user, ctx.table
+	var updated poker.TableItem
+	var action poker.ItemAction
+	var req itemUpdateRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	if err := req.Card.Validate(); err != nil {
+		return nil, err
+	}
+	var conflict *ConflictResponse
+	if err := table.Update(ctx, func(t *poker.Table) error {
+		up, act, err := updateItem(ctx, &req)
+		if err != nil {
+			conflict = newConflictResponse(ctx, req.ID, err)
+			return err
+		}
+		updated, action = *up, act
+		return nil
+	}); err != nil {
+		if conflict != nil {
+			logger.Info.Printf("%s update conflict: %s", ctx, err)
+			return httpx.JSON(http.StatusConflict, conflict), nil
+		}
+		return nil, err
+	}
+	logger.Debug.Printf("%s update dest=%+v", ctx, updated)
+	// push updates: potentially long operation - check
+	ctx.table.NotifyOthers(ctx, curUser, poker.NewPushItems(&updated).WithAction(action))
+	resp := updated
+	resp.ApplyVisibilityRules(curUser) // moving a covered card does not reveal it
+	return httpx.JSON(http.StatusOK, ItemUpdatedResponse{Updated: &resp}), nil
+}
+
+func (s *server) joinTable(r *http.Request) (*httpx.Response, error) {
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
 	var players map[uuid.UUID]*poker.Player
 	var updated []*poker.TableItem
-	if err := ctx.table.Update(func(t *poker.Table) error {
+	var joined poker.Player
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		defer func() {
+			if p := t.Players[ctx.user.ID]; p != nil {
+				joined = *p
+				u := *p.User
+				joined.User = &u
+			}
+		}()
 		hasJoined := t.Players[ctx.user.ID] != nil
 		if hasJoined {
 			return nil
 		}
-		logger.Debug.Printf("players_joind=%d", len(t.Players))
-		if len(t.Players) >= maxPlayers {
-			return httpx.NewError(http.StatusForbidden, "this table is full")
+		logger.Debug.Printf("players_joind=%d", len(t.Players))
+		if t.Locked {
+			return httpx.NewError(http.StatusForbidden, "this table is locked")
+		}
+		if t.IsFull(ctx.user, maxPlayers) {
+			return httpx.NewError(http.StatusForbidden, "this table is full, you can wait for a free seat")
+		}
+		updated = t.Join(ctx.user)
+		players = t.Players
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// push updates: potentially long operation - check
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushPlayerJoined(players, updated...))
+	if httpx.AcceptsJSON(r) {
+		return httpx.JSON(http.StatusOK, &joined), nil
+	}
+	return httpx.Redirect(fmt.Sprintf("/games/%s", ctx.table.ID)), nil
+}
+
+// WaitResponse describes a user's place in a table waitlist
+type WaitResponse struct {
+	Position int  `json:"position"`
+	Seated   bool `json:"seated"`
+}
+
+func (s *server) wait(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var resp WaitResponse
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if t.Players[ctx.user.ID] != nil {
+			resp.Seated = true
+			return nil
+		}
+		if t.Locked {
+			return httpx.NewError(http.StatusForbidden, "this table is locked")
+		}
+		resp.Position = t.Wait(ctx.user)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=wait position=%d", ctx, resp.Position)
+	return httpx.JSON(http.StatusOK, &resp), nil
+}
+
+func (s *server) waitPosition(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var resp WaitResponse
+	if err := ctx.table.ReadLock(ctx, func(t *poker.Table) error {
+		resp.Seated = t.Players[ctx.user.ID] != nil
+		resp.Position = t.WaitPosition(ctx.user.ID)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return httpx.JSON(http.StatusOK, &resp), nil
+}
+
+func (s *server) renderTable(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	curUser, table := ctx.user, ctx.table
+	players := []*poker.Player{}
+	var felt poker.Color
+	var size poker.Size
+	errRedirect := errors.New("redirect")
+	if err := table.ReadLock(ctx, func(t *poker.Table) error {
+		if t.Players[curUser.ID] == nil {
+			return errRedirect
+		}
+		felt = t.Felt
+		size = t.Size()
+		for _, v := range t.SortedPlayers() {
+			p := *v
+			u := *v.User
+			p.User = &u
+			p.ApplyVisibilityRules(curUser)
+			players = append(players, &p)
+		}
+		return nil
+	}); err != nil {
+		if err == errRedirect {
+			return httpx.Redirect(fmt.Sprintf("/games/%s/join", table.ID)), nil
+		}
+		return nil, err
+	}
+	data := m{
+		"Felt":     felt,
+		"Players":  players,
+		"Size":     size,
+		"TableID":  table.ID,
+		"Username": curUser.Name,
+	}
+	if httpx.AcceptsJSON(r) {
+		return httpx.JSON(http.StatusOK, data), nil
+	}
+	return httpx.RenderFile(http.StatusOK, "web/poker.html", data)
+}
+
+// TableState is a table as it is seen by a particular user
+type TableState struct {
+	*poker.Table
+
+	Layout *poker.Layout `json:"layout"`
+
+	// Seats are ids of the players ordered by their seats
+	Seats []uuid.UUID `json:"seats"`
+}
+
+func newTableState(t *poker.Table) *TableState {
+	seats := []uuid.UUID{}
+	for _, p := range t.SortedPlayers() {
+		seats = append(seats, p.ID)
+	}
+	return &TableState{Table: t, Layout: t.Layout(), Seats: seats}
+}
+
+func getTableState(ctx context.Context, curUser *poker.User, table *poker.Table) (*TableState, error) {
+	var tableCopy *poker.Table
+	if err := table.ReadLock(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(curUser.ID); err != nil {
+			return err
+		}
+		var err error
+		// deep copy the current table - items must be modified
+		// as their content differes for different users due to ownership
+		tableCopy, err = t.DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	tableCopy.ApplyVisibilityRules(curUser)
+	tableCopy.Items = tableCopy.CompactItems(tableCopy.Items)
+	return newTableState(tableCopy), nil
+}
+
+// BootstrapResponse is everything a client needs to render a table on page load
+type BootstrapResponse struct {
+	State *TableState `json:"state"`
+
+	// Me is the player of the current user: identity, seat and color
+	Me *poker.Player `json:"me"`
+
+	Capabilities *CapabilitiesResponse `json:"capabilities"`
+}
+
+func (s *server) bootstrap(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	state, err := getTableState(ctx, ctx.user, ctx.table)
+	if err != nil {
+		return nil, err
+	}
+	return httpx.JSON(http.StatusOK, &BootstrapResponse{
+		State:        state,
+		Me:           state.Players[ctx.user.ID],
+		Capabilities: s.newCapabilitiesResponse(),
+	}).Compressible(), nil
+}
+
+func (s *server) tableState(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	if since := r.URL.Query().Get("since"); since != "" {
+		version, err := strconv.Atoi(since)
+		if err != nil {
+			return nil, httpx.NewError(http.StatusBadRequest, "bad since: "+since)
+		}
+		diff, err := getTableDiff(ctx, ctx.user, ctx.table, version)
+		if err != nil {
+			return nil, err
+		}
+		if diff != nil {
+			return httpx.JSON(http.StatusOK, diff).Compressible(), nil
+		}
+		// too old or unknown version: fall back to the full state
+	}
+	tableCopy, err := getTableState(ctx, ctx.user, ctx.table)
+	if err != nil {
+		return nil, err
+	}
+	return httpx.JSON(http.StatusOK, tableCopy).Compressible(), nil
+}
+
+// TableDiff carries items changed since a given version of a table
+type TableDiff struct {
+	Diff    bool                        `json:"diff"`
+	Since   int                         `json:"since"`
+	Version int                         `json:"version"`
+	Items   []*poker.TableItem          `json:"items"`
+	Players map[uuid.UUID]*poker.Player `json:"players"`
+	Pot     int                         `json:"pot"`
+}
+
+// getTableDiff returns items changed since a given version or nil if the full state is needed
+func getTableDiff(ctx context.Context, curUser *poker.User, table *poker.Table, since int) (*TableDiff, error) {
+	var diff *TableDiff
+	if err := table.ReadLock(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(curUser.ID); err != nil {
+			return err
+		}
+		ids, ok := t.ChangedSince(since)
+		if !ok {
+			return nil
+		}
+		items := []*poker.TableItem{}
+		for _, id := range ids {
+			if it := t.Items.Get(id); it != nil {
+				items = append(items, it)
+			}
+		}
+		// deep copy as the content differs for different users due to visibility rules
+		changed := poker.NewPushItems(t.CompactItems(items)...)
+		changed.Players = t.Players
+		push, err := changed.DeepCopy()
+		if err != nil {
+			return err
+		}
+		push.ApplyVisibilityRules(curUser)
+		diff = &TableDiff{
+			Diff:    true,
+			Since:   since,
+			Version: t.Version,
+			Items:   push.Items,
+			Players: push.Players,
+			Pot:     t.Pot,
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+func (s *server) itemState(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	id, err := strconv.Atoi(mux.Vars(r)["itemID"])
+	if err != nil {
+		return nil, httpx.NewError(http.StatusBadRequest, "bad item id")
+	}
+	var item poker.TableItem
+	if err := ctx.table.ReadLock(ctx, func(t *poker.Table) error {
+		if err := t.RequireMember(ctx.user.ID); err != nil {
+			return err
+		}
+		it := t.Items.Get(id)
+		if it == nil {
+			return httpx.NewError(http.StatusNotFound, "item not found")
+		}
+		item = *it
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	item.ApplyVisibilityRules(ctx.user)
+	return httpx.JSON(http.StatusOK, &item), nil
+}
+
+func (s *server) newTable(r *http.Request) (*httpx.Response, error) {
+	sess, err := getUserFromSession(r, s.users)
+	if err != nil {
+		return nil, err
+	}
+	curUser := sess.user
+	if !s.conf.allowAnonCreate && curUser.Anonymous {
+		// send the user to choose a name and come back to create the table
+		return httpx.Redirect(fmt.Sprintf("/users/profile?%s=%s",
+			retPathKey, url.QueryEscape(r.URL.RequestURI()))), nil
+	}
+	logger.Info.Printf("user_id=%s action=table_created", curUser.ID)
+
+	if s.conf.maxTables > 0 && countTables(s.tables, nil) >= s.conf.maxTables {
+		metricTablesRejected.Add(1)
+		return nil, httpx.NewError(http.StatusTooManyRequests, "too many tables, try later")
+	}
+	if s.conf.maxTablesPerUser > 0 &&
+		countTables(s.tables, func(t *poker.Table) bool { return t.IsCreator(curUser) }) >= s.conf.maxTablesPerUser {
+		metricTablesRejected.Add(1)
+		return nil, httpx.NewError(http.StatusForbidden, "you have created too many tables")
+	}
+	tpl, err := poker.ParseTemplate(r.URL.Query().Get("template"))
+	if err != nil {
+		return nil, err
+	}
+	table := poker.NewTable(uuid.New(), defaultBankChips)
+	if bank := r.URL.Query().Get("bank"); bank != "" {
+		counts, err := poker.ParseBank(bank)
+		if err != nil {
+			return nil, err
+		}
+		table = poker.NewTableWithBank(table.ID, counts)
+	}
+	table.Template = tpl
+	table.SetClock(s.clock)
+	table.SetOnChange(s.markDirty)
+	table.ProvablyFair = s.conf.provablyFair
+	table.StartGame()
+	table.BuyIn = s.conf.buyIn
+	table.PrivateStacks = s.conf.privateStacks
+	table.MaxBuyIn = s.conf.maxBuyIn
+	table.StackedDeck = s.conf.stackedDeck
+	table.CreatedBy = curUser.ID
+	if table.Felt, err = poker.ParseFelt(r.URL.Query().Get("felt")); err != nil {
+		return nil, err
+	}
+	stakes := [3]int{}
+	for i, name := range []string{"small_blind", "big_blind", "max_bet"} {
+		if stakes[i], err = queryInt(r.URL, name); err != nil {
+			return nil, err
+		}
+	}
+	if err := table.SetStakes(stakes[0], stakes[1], stakes[2]); err != nil {
+		return nil, err
+	}
+	if table.MaxHand, err = queryInt(r.URL, "max_hand"); err != nil {
+		return nil, err
+	}
+	if table.MaxHand < 0 {
+		return nil, httpx.NewError(http.StatusBadRequest, "max_hand can not be negative")
+	}
+	size := [2]int{}
+	for i, name := range []string{"width", "height"} {
+		if size[i], err = queryInt(r.URL, name); err != nil {
+			return nil, err
+		}
+	}
+	if err := table.SetSize(size[0], size[1]); err != nil {
+		return nil, err
+	}
+	table.Name = strings.TrimSpace(r.URL.Query().Get("name"))
+	if table.Name == "" {
+		table.Name = curUser.Name + "'s table"
+	}
+	s.tables.Set(table.ID, table)
+	table.Join(curUser)
+	metricTablesCreated.Add(1)
+
+	return httpx.Redirect(fmt.Sprintf("/games/%s", table.ID)), nil
+}
+
+func (s *server) userTables(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).build()
+	if err != nil {
+		return nil, err
+	}
+	res := []*TableSummary{}
+	s.tables.Each(func(id uuid.UUID, t *poker.Table) bool {
+		logError(t.ReadLock(r.Context(), func(t *poker.Table) error {
+			if t.Players[ctx.user.ID] == nil {
+				return nil
+			}
+			res = append(res, newTableSummary(t))
+			return nil
+		}), "userTables")
+		return true
+	})
+	return httpx.JSON(http.StatusOK, res), nil
+}
+
+// tableFilter selects tables by a name substring and a creator
+type tableFilter struct {
+	// q is a case insensitive substring of a table name
+	q string
+
+	// creator is an exact name or id of the creator
+	creator string
+}
+
+func newTableFilter(u *url.URL) *tableFilter {
+	return &tableFilter{
+		q:       strings.ToLower(strings.TrimSpace(u.Query().Get("q"))),
+		creator: strings.TrimSpace(u.Query().Get("creator")),
+	}
+}
+
+func (f *tableFilter) match(users poker.UserMap, t *poker.Table) bool {
+	if f.q != "" && !strings.Contains(strings.ToLower(t.Name), f.q) {
+		return false
+	}
+	if f.creator == "" || f.creator == t.CreatedBy.String() {
+		return true
+	}
+	u, found := users.Get(t.CreatedBy)
+	return found && u.Name == f.creator
+}
+
+func (s *server) listTables(r *http.Request) (*httpx.Response, error) {
+	res := []*TableSummary{}
+	filter := newTableFilter(r.URL)
+	s.tables.Each(func(id uuid.UUID, t *poker.Table) bool {
+		logError(t.ReadLock(r.Context(), func(t *poker.Table) error {
+			if filter.match(s.users, t) {
+				res = append(res, newTableSummary(t))
+			}
+			return nil
+		}), "listTables")
+		return true
+	})
+	// empty tables are the least interesting ones
+	sort.SliceStable(res, func(i, j int) bool { return res[i].Players > 0 && res[j].Players == 0 })
+	return httpx.JSON(http.StatusOK, res), nil
+}
+
+func (s *server) reserveSeats(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		Names []string `json:"names"`
+	}
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	for _, name := range req.Names {
+		if !usernameValidator.MatchString(strings.TrimSpace(name)) {
+			return nil, httpx.NewError(http.StatusBadRequest, "invalid characters in user name")
+		}
+	}
+	var reservations []*poker.Reservation
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can reserve seats")
 		}
-		updated = t.Join(ctx.user)
-		players = t.Players
+		if err := t.Reserve(req.Names, maxPlayers); err != nil {
+			return err
+		}
+		reservations = append(reservations, t.Reservations...)
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	// push updates: potentially long operation - check
-	ctx.table.NotifyOthers(ctx.user, poker.NewPushPlayerJoined(players, updated...))
-	return httpx.Redirect(fmt.Sprintf("/games/%s", ctx.table.ID)), nil
+	logger.Info.Printf("%s action=reserve seats=%d", ctx, len(reservations))
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushRefresh())
+	return httpx.JSON(http.StatusOK, m{"reservations": reservations}), nil
 }
 
-func (s *server) renderTable(r *http.Request) (*httpx.Response, error) {
+func (s *server) lockTable(r *http.Request) (*httpx.Response, error) {
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	curUser, table := ctx.user, ctx.table
-	players := []*poker.Player{}
-	errRedirect := errors.New("redirect")
-	if err := table.ReadLock(func(t *poker.Table) error {
-		if t.Players[curUser.ID] == nil {
-			return errRedirect
-		}
-		for _, v := range t.Players {
-			players = append(players, v)
+	var summary *TableSummary
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can lock the table")
 		}
+		t.Locked = !t.Locked
+		summary = newTableSummary(t)
 		return nil
 	}); err != nil {
-		if err == errRedirect {
-			return httpx.Redirect(fmt.Sprintf("/games/%s/join", table.ID)), nil
-		}
 		return nil, err
 	}
-	return httpx.RenderFile(http.StatusOK, "web/poker.html", m{
-		"Players":  players,
-		"TableID":  table.ID,
-		"Username": curUser.Name,
-	})
+	logger.Info.Printf("%s action=lock locked=%t", ctx, summary.Locked)
+	return httpx.JSON(http.StatusOK, summary), nil
 }
 
-func getTableState(curUser *poker.User, table *poker.Table) (*poker.Table, error) {
-	var tableCopy *poker.Table
-	if err := table.ReadLock(func(t *poker.Table) error {
-		if t.Players[curUser.ID] == nil {
-			return httpx.NewError(http.StatusForbidden, "you are not at the table")
+// resetPlayerRequest refers to a player at the table
+type resetPlayerRequest struct {
+	UserID uuid.UUID `json:"user_id"`
+}
+
+func (s *server) resetPlayer(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var req resetPlayerRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can reset players")
 		}
-		var err error
-		// deep copy the current table - items must be modified
-		// as their content differes for different users due to ownership
-		tableCopy, err = t.DeepCopy()
-		return err
+		p := t.Players[req.UserID]
+		if p == nil {
+			return httpx.NewError(http.StatusNotFound, "player not found")
+		}
+		t.ResetPlayer(p)
+		return nil
 	}); err != nil {
 		return nil, err
 	}
-	for _, it := range tableCopy.Items {
-		it.ApplyVisibilityRules(curUser)
-	}
-	return tableCopy, nil
+	logger.Info.Printf("%s action=reset_player player_id=%s", ctx, req.UserID)
+	// chips got replaced, so everyone including the creator has to reload the table
+	ctx.table.NotifyOthers(ctx, &poker.User{}, poker.NewPushRefresh())
+	return httpx.JSON(http.StatusOK, m{}), nil
 }
 
-func (s *server) tableState(r *http.Request) (*httpx.Response, error) {
+func (s *server) pinItem(r *http.Request) (*httpx.Response, error) {
 	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	tableCopy, err := getTableState(ctx.user, ctx.table)
+	var req itemRequest
+	if err := decodeStrict(r, &req); err != nil {
+		return nil, err
+	}
+	id, err := req.id()
 	if err != nil {
 		return nil, err
 	}
-	return httpx.JSON(http.StatusOK, tableCopy), nil
+	var updated poker.TableItem
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can pin items")
+		}
+		item := t.Items.Get(id)
+		if item == nil {
+			return httpx.NewError(http.StatusNotFound, "item not found")
+		}
+		item.Pinned = !item.Pinned
+		updated = *item
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	logger.Info.Printf("%s action=pin item=%d pinned=%t", ctx, updated.ID, updated.Pinned)
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushItems(&updated))
+	resp := updated
+	resp.ApplyVisibilityRules(ctx.user) // pinning a covered card does not reveal it
+	return httpx.JSON(http.StatusOK, &ItemUpdatedResponse{Updated: &resp}), nil
 }
 
-func (s *server) newTable(r *http.Request) (*httpx.Response, error) {
-	sess, err := getUserFromSession(r, s.users)
+func (s *server) setFelt(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
 	if err != nil {
 		return nil, err
 	}
-	curUser := sess.user
-	logger.Info.Printf("user_id=%s action=table_created", curUser.ID)
-
-	table := poker.NewTable(uuid.New(), 50).StartGame()
-	s.tables.Set(table.ID, table)
-	table.Join(curUser)
+	req := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, err
+	}
+	felt, err := poker.ParseFelt(req["felt"])
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can change the felt")
+		}
+		t.Felt = felt
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	ctx.table.NotifyOthers(ctx, ctx.user, poker.NewPushRefresh())
+	return httpx.JSON(http.StatusOK, m{"felt": felt}), nil
+}
 
-	return httpx.Redirect(fmt.Sprintf("/games/%s", table.ID)), nil
+func (s *server) deleteUser(r *http.Request) (*httpx.Response, error) {
+	sess, err := getUserFromSession(r, s.users)
+	if err != nil || sess.UserID == uuid.Nil {
+		return nil, errUnauthorized
+	}
+	s.tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		var left bool
+		logError(t.Update(r.Context(), func(t *poker.Table) error {
+			t.StopWaiting(sess.UserID)
+			if t.Players[sess.UserID] == nil {
+				return nil
+			}
+			t.Leave(&poker.User{ID: sess.UserID})
+			t.SeatWaiters(s.users, maxPlayers)
+			left = true
+			return nil
+		}), "deleteUser")
+		if left {
+			t.NotifyOthers(r.Context(), &poker.User{ID: sess.UserID}, poker.NewPushRefresh())
+		}
+		return true
+	})
+	if s.users.Remove(sess.UserID) {
+		logger.Info.Printf("user_id=%s user_deleted", sess.UserID)
+		logError(s.saveState(), "deleteUser saveState")
+	}
+	return httpx.JSON(http.StatusOK, m{"deleted": true}).
+		SetCookie(newEmptySession()).
+		SetCookie(newLastName(s.clock.Now(), "")), nil
 }
 
 func (s *server) newUser(r *http.Request) (*httpx.Response, error) {
@@ -697,15 +2289,16 @@ func (s *server) newUser(r *http.Request) (*httpx.Response, error) {
 	old, err := getUserFromSession(r, s.users)
 	if err != nil || old.user == nil {
 		// Cookie not found or empty: create and set a new one
-		name := "Anon" + randomString()
+		name := randomName(s.conf.anonPrefix, s.users)
 		if ln, err := r.Cookie("last_name"); err == nil {
 			if ln.Value != "" {
 				name = ln.Value
 			}
 		}
-		shouldChangeName := strings.HasPrefix(strings.ToLower(name), "anon")
-		now := time.Now()
+		shouldChangeName := strings.HasPrefix(strings.ToLower(name), strings.ToLower(s.conf.anonPrefix))
+		now := s.clock.Now()
 		u := poker.NewUser(uuid.New(), name, now)
+		u.Anonymous = shouldChangeName
 		s.users.Set(u.ID, u)
 		sess := &session{UserID: u.ID, CreatedAt: now, Name: u.Name}
 		cookie := newSessionCookie(now, sess.toCookie())
@@ -742,12 +2335,92 @@ func (s *server) index(r *http.Request) (*httpx.Response, error) {
 	}, emptySess)
 }
 
-func (s *server) loadState() error { return s.state.load(s.users, s.tables) }
+// VersionResponse describes the running server build
+type VersionResponse struct {
+	Version   string    `json:"version"`
+	Commit    string    `json:"commit"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func newVersionResponse() *VersionResponse {
+	return &VersionResponse{Version: version, Commit: commit, StartedAt: startedAt}
+}
+
+func (s *server) version(r *http.Request) (*httpx.Response, error) {
+	return httpx.JSON(http.StatusOK, newVersionResponse()), nil
+}
+
+// CapabilitiesResponse lets clients detect features and limits of this server
+type CapabilitiesResponse struct {
+	Features map[string]bool `json:"features"`
+
+	MaxPlayers   int          `json:"max_players"`
+	ChipsSet     []poker.Chip `json:"chips_set"`
+	CardBacks    []string     `json:"card_backs"`
+	BuyIn        int          `json:"buy_in"`
+	MaxBuyIn     int          `json:"max_buy_in"`
+	SaveEveryMs  int64        `json:"save_every_ms"`
+	WSPingMs     int64        `json:"ws_ping_ms"`
+	MaxConns     int          `json:"max_conns_per_user"`
+	CreatesLimit int          `json:"max_creates_per_min"`
+	JoinsLimit   int          `json:"max_joins_per_min"`
+}
+
+func (s *server) capabilities(r *http.Request) (*httpx.Response, error) {
+	return httpx.JSON(http.StatusOK, s.newCapabilitiesResponse()), nil
+}
+
+func (s *server) newCapabilitiesResponse() *CapabilitiesResponse {
+	return &CapabilitiesResponse{
+		Features: map[string]bool{
+			"spectators":       true,
+			"betting":          true,
+			"waitlist":         true,
+			"reservations":     true,
+			"provably_fair":    s.conf.provablyFair,
+			"private_stacks":   s.conf.privateStacks,
+			"stacked_deck":     s.conf.stackedDeck,
+			"persistence":      !s.conf.noPersist,
+			"idle_kick":        s.conf.idleKickAfter > 0,
+			"admin":            s.conf.adminToken != "",
+			"debug":            s.conf.debug,
+			"idempotency_keys": true,
+			"ws_compression":   s.conf.wsCompression,
+			"anon_create":      s.conf.allowAnonCreate,
+		},
+		MaxPlayers:   maxPlayers,
+		ChipsSet:     poker.ChipsSet(),
+		CardBacks:    poker.CardBacks,
+		BuyIn:        s.conf.buyIn,
+		MaxBuyIn:     s.conf.maxBuyIn,
+		SaveEveryMs:  saveStateEvery.Milliseconds(),
+		WSPingMs:     s.conf.wsPingPeriod.Milliseconds(),
+		MaxConns:     s.conf.maxConnsPerUser,
+		CreatesLimit: s.conf.maxCreatesPerMin,
+		JoinsLimit:   s.conf.maxJoinsPerMin,
+	}
+}
+
+func (s *server) readyz(r *http.Request) (*httpx.Response, error) {
+	return httpx.JSON(http.StatusOK, m{"status": "ok", "build": newVersionResponse()}), nil
+}
+
+func (s *server) loadState() error {
+	if err := s.state.Load(s.users, s.tables); err != nil {
+		return err
+	}
+	s.tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		t.SetClock(s.clock)
+		t.SetOnChange(s.markDirty)
+		t.LinkUsers(s.users)
+		return true
+	})
+	return nil
+}
 
-func (s *server) saveState() error { return s.state.save(s.users, s.tables) }
+func (s *server) saveState() error { return s.state.Save(s.users, s.tables) }
 
 func saveStateLoop(s *server) {
-	const saveStateEvery = 10 * time.Second
 	for range time.Tick(saveStateEvery) {
 		if err := s.saveState(); err != nil {
 			logger.Error.Printf("saveStateLoop: %s", err)
@@ -755,6 +2428,205 @@ func saveStateLoop(s *server) {
 	}
 }
 
+// markDirty signals that a table has changed. Bursts of updates are coalesced:
+// a single pending signal stands for all updates since it was received
+func (s *server) markDirty() {
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// autoSaveLoop saves the state shortly after tables change: the delay coalesces bursts
+// of updates into a single save. saveStateLoop still runs as a safety net
+func autoSaveLoop(s *server, delay time.Duration) {
+	for range s.dirty {
+		time.Sleep(delay)
+		select {
+		case <-s.dirty: // covered by this save
+		default:
+		}
+		if err := s.saveState(); err != nil {
+			logger.Error.Printf("autoSaveLoop: %s", err)
+		}
+	}
+}
+
+// seatedUsers returns ids of all users who sit at least at one table
+func (s *server) seatedUsers() map[uuid.UUID]bool {
+	seated := map[uuid.UUID]bool{}
+	s.tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		logError(t.ReadLock(context.Background(), func(t *poker.Table) error {
+			for id := range t.Players {
+				seated[id] = true
+			}
+			return nil
+		}), "seatedUsers")
+		return true
+	})
+	return seated
+}
+
+// pruneUsers removes users that have not been seen for longer than
+// a configured TTL and do not sit at any table
+func (s *server) pruneUsers(now time.Time) int {
+	seated := s.seatedUsers()
+	stale := []uuid.UUID{}
+	s.users.Each(func(id uuid.UUID, u *poker.User) bool {
+		ttl := s.conf.userTTL
+		if u.Anonymous && s.conf.anonTTL < ttl {
+			ttl = s.conf.anonTTL
+		}
+		if !seated[id] && u.IsIdle(now, ttl) {
+			stale = append(stale, id)
+		}
+		return true
+	})
+	for _, id := range stale {
+		s.users.Remove(id)
+	}
+	return len(stale)
+}
+
+func pruneUsersLoop(s *server) {
+	const pruneUsersEvery = time.Hour
+	for range time.Tick(pruneUsersEvery) {
+		if n := s.pruneUsers(s.clock.Now()); n > 0 {
+			logger.Info.Printf("pruneUsersLoop: users_removed=%d", n)
+		}
+	}
+}
+
+// reapTables removes tables whose players all have been offline and inactive for longer
+// than a configured TTL and tables that have been empty for that long
+func (s *server) reapTables(now time.Time) int {
+	abandoned := []*poker.Table{}
+	s.tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		logError(t.ReadLock(context.Background(), func(t *poker.Table) error {
+			if len(t.Players) == 0 && t.EmptySince != nil && now.Sub(*t.EmptySince) <= s.conf.tableTTL {
+				return nil
+			}
+			for _, p := range t.Players {
+				// players share their users, so activity anywhere keeps the table
+				if p.IsOnline() || !p.IsIdle(now, s.conf.tableTTL) {
+					return nil
+				}
+			}
+			abandoned = append(abandoned, t)
+			return nil
+		}), "reapTables")
+		return true
+	})
+	for _, t := range abandoned {
+		s.tables.Remove(t.ID)
+		logError(t.Update(context.Background(), func(t *poker.Table) error {
+			for _, p := range t.Players {
+				p.Disconnect(poker.TableClosed) // terminates web socket loops
+			}
+			return nil
+		}), "reapTables")
+		logger.Info.Printf("table_id=%s table_reaped", t.ID)
+	}
+	metricTablesReaped.Add(int64(len(abandoned)))
+	return len(abandoned)
+}
+
+// kickIdlePlayers warns tables about players that went offline and idle and removes
+// them once the warning time is over unless they come back. Returns removed players count
+func (s *server) kickIdlePlayers(now time.Time) int {
+	kicked := 0
+	s.tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		due := false
+		logError(t.ReadLock(context.Background(), func(t *poker.Table) error {
+			for _, p := range t.Players {
+				due = due || p.IsIdleCheckDue(now, s.conf.idleKickAfter)
+			}
+			return nil
+		}), "kickIdlePlayers")
+		if !due {
+			return true // most tables have nobody idle: do not take their write locks
+		}
+		warnings := []*poker.Push{}
+		left := []*poker.Player{}
+		logError(t.Update(context.Background(), func(t *poker.Table) error {
+			for _, p := range t.SortedPlayers() {
+				// a warned player who has been active since is kept, CheckIdle cancels the removal
+				if p.ShouldKick(now) && !p.IsOnline() && p.IsIdle(now, s.conf.idleKickAfter) {
+					p.Disconnect(poker.Idle)
+					t.Leave(p.User)
+					left = append(left, p)
+					continue
+				}
+				if p.CheckIdle(now, s.conf.idleKickAfter, s.conf.idleKickWarning) {
+					warnings = append(warnings, poker.NewPushPlayerIdle(p, s.conf.idleKickWarning))
+				}
+			}
+			if len(left) > 0 {
+				t.SeatWaiters(s.users, maxPlayers)
+			}
+			return nil
+		}), "kickIdlePlayers")
+		for _, push := range warnings {
+			t.NotifyOthers(context.Background(), &poker.User{}, push)
+		}
+		for _, p := range left {
+			logger.Info.Printf("table_id=%s user_id=%s idle_player_kicked", t.ID, p.ID)
+			t.NotifyOthers(context.Background(), p.User, poker.NewPushRefresh())
+		}
+		kicked += len(left)
+		return true
+	})
+	return kicked
+}
+
+func kickIdlePlayersLoop(s *server) {
+	const checkIdleEvery = 5 * time.Second
+	for range time.Tick(checkIdleEvery) {
+		s.kickIdlePlayers(s.clock.Now())
+	}
+}
+
+// releaseExpiredGrabs clears grabs that were never released and tells the players
+// the items are free again. Returns released items count
+func (s *server) releaseExpiredGrabs(now time.Time) int {
+	released := 0
+	s.tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		expired := false
+		logError(t.ReadLock(context.Background(), func(t *poker.Table) error {
+			expired = t.HasExpiredGrabs(now)
+			return nil
+		}), "releaseExpiredGrabs")
+		if !expired {
+			return true // do not take the write lock of idle tables
+		}
+		var items poker.TableItemList
+		logError(t.Update(context.Background(), func(t *poker.Table) error {
+			items = t.ReleaseExpiredGrabs(now).Copy()
+			return nil
+		}), "releaseExpiredGrabs")
+		if len(items) > 0 {
+			t.NotifyOthers(context.Background(), &poker.User{}, poker.NewPushItems(items...))
+		}
+		released += len(items)
+		return true
+	})
+	return released
+}
+
+func releaseGrabsLoop(s *server) {
+	const releaseGrabsEvery = time.Second
+	for range time.Tick(releaseGrabsEvery) {
+		s.releaseExpiredGrabs(s.clock.Now())
+	}
+}
+
+func reapTablesLoop(s *server) {
+	const reapTablesEvery = time.Hour
+	for range time.Tick(reapTablesEvery) {
+		s.reapTables(s.clock.Now())
+	}
+}
+
 func getUserFromSession(r *http.Request, users poker.UserMap) (*session, error) {
 	sess := &session{}
 	cookie, err := r.Cookie("session")
@@ -772,15 +2644,30 @@ func getUserFromSession(r *http.Request, users poker.UserMap) (*session, error)
 	return sess, nil
 }
 
-func authenticated(users poker.UserMap, f httpx.RequestHandler) httpx.RequestHandler {
+func touchUser(users poker.UserMap, id uuid.UUID, now time.Time) {
+	logError(users.Update(id, func(u *poker.User) error {
+		if u == nil {
+			return nil
+		}
+		if now.Sub(u.SeenAt()) < lastSeenThrottle {
+			return nil
+		}
+		u.Touch(now) // players share the user, they read it under table locks
+		return nil
+	}), "touchUser")
+}
+
+func (s *server) authenticated(f httpx.RequestHandler) httpx.RequestHandler {
 	return func(r *http.Request) (*httpx.Response, error) {
-		sess, err := getUserFromSession(r, users)
-		if err != nil {
-			return httpx.String(http.StatusUnauthorized), nil
+		sess, err := getUserFromSession(r, s.users)
+		if err == nil && sess.user == nil && sess.UserID != uuid.Nil {
+			logger.Info.Printf("session user_id=%s not found", sess.UserID)
+			return nil, errUserGone
 		}
-		if sess.user == nil {
-			return httpx.String(http.StatusUnauthorized), nil
+		if err != nil || sess.user == nil {
+			return nil, errUnauthorized
 		}
+		touchUser(s.users, sess.user.ID, s.clock.Now())
 		return f(r)
 	}
 }
@@ -802,35 +2689,28 @@ func handleSignalsLoop(srv *server) {
 	os.Exit(0)
 }
 
-// TODO: add metrics
 // TODO: connect metrics to Graphana
-// TODO: decide what to do with abandoned tables. Now they not only stay in memory but also
-// keep websocket groutines/channels forever
-func main() {
-	s := &server{
-		endpoint: ":8080",
-		state:    NewStateFile(statePath),
-
-		tables: poker.NewTableMapSyncronized(),
-		users:  poker.NewUserMapSyncronized(),
-	}
-	if err := s.loadState(); err != nil {
-		logger.Error.Printf("server.loadState %s", err)
-	}
+// routes returns the handler of all the server endpoints including static files
+func (s *server) routes() http.Handler {
 	auth := func(f httpx.RequestHandler) httpx.RequestHandler {
-		return authenticated(s.users, f)
+		return s.authenticated(f)
+	}
+	// once is for mutating actions that clients may retry with an Idempotency-Key
+	once := func(f httpx.RequestHandler) httpx.RequestHandler {
+		return auth(s.idempotent(f))
 	}
 	redirectIfNoAuth := func(url string, f httpx.RequestHandler) httpx.RequestHandler {
 		return func(r *http.Request) (*httpx.Response, error) {
 			resp, err := auth(f)(r)
-			if err != nil {
-				return nil, err
+			if errors.Is(err, errUserGone) {
+				// re-create the user transparently: last_name cookie is kept for name continuity
+				return httpx.Redirect(fmt.Sprintf("%s?%s=%s", url, retPathKey, r.URL.Path)).
+					SetCookie(newEmptySession()), nil
 			}
-			// logger.Debug.Println(resp.Code())
-			if resp.Code() == http.StatusUnauthorized {
+			if errors.Is(err, errUnauthorized) {
 				return httpx.Redirect(fmt.Sprintf("%s?ret_path=%s", url, r.URL.Path)), nil
 			}
-			return resp, nil
+			return resp, err
 		}
 	}
 
@@ -841,27 +2721,120 @@ func main() {
 		return httpx.JSON(http.StatusOK, m{}), nil
 	})).Methods("GET")
 
-	r.HandleFunc("/games/new", httpx.H(redirectIfNoAuth("/users/new", s.newTable)))
-	r.HandleFunc("/games/{id:[a-z0-9-]+}",
+	r.HandleFunc("/version", httpx.H(s.version)).Methods("GET")
+	r.HandleFunc("/capabilities", httpx.H(s.capabilities)).Methods("GET")
+	r.HandleFunc("/readyz", httpx.H(s.readyz)).Methods("GET")
+
+	r.HandleFunc("/games", httpx.H(auth(s.listTables))).Methods("GET")
+	r.HandleFunc("/games/new", httpx.H(redirectIfNoAuth("/users/new", s.rateLimited(s.createLimit, s.newTable))))
+	r.HandleFunc("/games/"+tableIDRoute,
 		httpx.H(redirectIfNoAuth("/users/new", s.renderTable))).Methods("GET")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/state",
+	r.HandleFunc("/games/"+tableIDRoute+"/state",
 		httpx.H(auth(s.tableState))).Methods("GET")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/join",
-		httpx.H(auth(s.joinTable))).Methods("GET")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/update",
+	r.HandleFunc("/games/"+tableIDRoute+"/bootstrap",
+		httpx.H(auth(s.bootstrap))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/items/{itemID:[0-9]+}",
+		httpx.H(auth(s.itemState))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/join",
+		httpx.H(auth(s.rateLimited(s.joinLimit, s.joinTable)))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/update",
 		httpx.H(auth(s.updateTable))).Methods("POST")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/show_card",
+	r.HandleFunc("/games/"+tableIDRoute+"/show_card",
 		httpx.H(auth(s.showCard))).Methods("POST")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/take_card",
-		httpx.H(auth(s.takeCard))).Methods("POST")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/give_card",
-		httpx.H(auth(s.giveCard))).Methods("POST")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/listen",
+	r.HandleFunc("/games/"+tableIDRoute+"/unreveal",
+		httpx.H(auth(s.unrevealCard))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/take_card",
+		httpx.H(once(s.takeCard))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/give_card",
+		httpx.H(once(s.giveCard))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/pass_card",
+		httpx.H(once(s.passCard))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/return_card",
+		httpx.H(auth(s.returnCard))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/grab",
+		httpx.H(auth(s.grabItem))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/release",
+		httpx.H(auth(s.releaseItem))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/bet",
+		httpx.H(once(s.bet))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/new_hand",
+		httpx.H(once(s.newHand))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/rebuy",
+		httpx.H(once(s.rebuy))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/hide_stack",
+		httpx.H(auth(s.hideStack))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/nickname",
+		httpx.H(auth(s.nickname))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/card_back",
+		httpx.H(auth(s.cardBack))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/recolor",
+		httpx.H(auth(s.recolor))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/deal",
+		httpx.H(once(s.deal))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/burn",
+		httpx.H(once(s.burn))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/cover_all",
+		httpx.H(auth(s.coverAll))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/clear_board",
+		httpx.H(once(s.clearBoard))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/deck_audit",
+		httpx.H(auth(s.deckAudit))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/show_to",
+		httpx.H(auth(s.showTo))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/flip_mine",
+		httpx.H(auth(s.flipMine))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/result",
+		httpx.H(auth(s.result))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/fold",
+		httpx.H(once(s.fold))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/reserve",
+		httpx.H(auth(s.reserveSeats))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/lock",
+		httpx.H(auth(s.lockTable))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/reset_player",
+		httpx.H(auth(s.resetPlayer))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/pin",
+		httpx.H(auth(s.pinItem))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/felt",
+		httpx.H(auth(s.setFelt))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/move_deck",
+		httpx.H(auth(s.moveDeck))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/wait",
+		httpx.H(auth(s.wait))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/wait",
+		httpx.H(auth(s.waitPosition))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/share",
+		httpx.H(auth(s.shareTable))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/unshare",
+		httpx.H(auth(s.unshareTable))).Methods("POST")
+	r.HandleFunc("/games/"+tableIDRoute+"/spectate/state",
+		httpx.H(s.spectateState)).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/spectate/listen",
+		s.spectateListen).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/listen",
 		s.pushTableUpdates).Methods("GET")
-	r.HandleFunc("/games/{id:[a-z0-9-]+}/shuffle",
+	r.HandleFunc("/games/"+tableIDRoute+"/events",
+		s.streamTableEvents).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/shuffle",
 		httpx.H(auth(s.shuffle))).Methods("GET")
+	r.HandleFunc("/games/"+tableIDRoute+"/undo_shuffle",
+		httpx.H(once(s.undoShuffle))).Methods("POST")
+
+	r.HandleFunc("/admin/loglevel", httpx.H(s.adminOnly(s.logLevel))).Methods("POST")
+	r.HandleFunc("/debug/vars", httpx.H(s.adminOnly(s.metrics))).Methods("GET")
+
+	if s.conf.debug {
+		logger.Info.Printf("debug mode: debug endpoints are enabled")
+		r.HandleFunc("/debug/seed_table", httpx.H(s.seedTable)).Methods("POST")
+		r.HandleFunc("/games/"+tableIDRoute+"/debug/stream", s.streamRawPushes).Methods("GET")
+		r.HandleFunc("/games/"+tableIDRoute+"/conjure_card", httpx.H(auth(s.conjureCard))).Methods("POST")
+		r.HandleFunc("/games/"+tableIDRoute+"/set_deck_order", httpx.H(auth(s.setDeckOrder))).Methods("POST")
+	}
 
 	r.HandleFunc("/users/new", httpx.H(s.newUser))
+	r.HandleFunc("/users/delete", httpx.H(s.deleteUser)).Methods("POST")
+	r.HandleFunc("/users/tables",
+		httpx.H(auth(s.userTables))).Methods("GET")
 	r.HandleFunc("/users/profile",
 		httpx.H(redirectIfNoAuth("/users/new", s.profile))).
 		Methods("GET")
@@ -869,19 +2842,109 @@ func main() {
 		httpx.H(auth(s.updateProfile))).
 		Methods("POST")
 
-	http.Handle("/", r)
+	root := http.NewServeMux()
+	root.Handle("/", httpx.Recover(r))
 
-	http.Handle("/robots.txt",
+	root.Handle("/robots.txt",
 		http.StripPrefix("/", http.FileServer(http.Dir("./web/"))))
 
-	http.Handle("/static/",
+	root.Handle("/static/",
 		http.StripPrefix("/static/", http.FileServer(http.Dir("./web/static"))))
 
+	return root
+}
+
+// newServer creates a server with empty state for a given config. With noPersist
+// set the state is kept in memory, so several servers can run side by side
+func newServer(conf config) *server {
+	s := &server{
+		conf:     conf,
+		endpoint: ":8080",
+		state:    NewStateFile(conf.statePath),
+
+		tables: poker.NewTableMapSyncronized(),
+		users:  poker.NewUserMapSyncronized(),
+
+		idempotency: newIdempotencyCache(),
+		conns:       newConnTracker(conf.maxConnsPerUser),
+		upgrader:    newUpgrader(conf),
+		createLimit: newRateLimiter(conf.maxCreatesPerMin, time.Minute),
+		joinLimit:   newRateLimiter(conf.maxJoinsPerMin, time.Minute),
+		clock:       poker.WallClock,
+		dirty:       make(chan struct{}, 1),
+	}
+	if conf.noPersist {
+		logger.Info.Printf("ephemeral mode: the state is not persisted")
+		s.state = NewMemoryStore()
+	}
+	return s
+}
+
+func main() {
+	var conf config
+	flag.IntVar(&conf.buyIn, "buy-in", poker.DefaultBuyIn, "amount of chips a player gets on joining a table")
+	flag.DurationVar(&conf.userTTL, "user-ttl", cookieExpiresAt, "how long inactive users are kept")
+	flag.DurationVar(&conf.anonTTL, "anon-ttl", 24*time.Hour, "how long inactive users who never chose a name are kept")
+	flag.BoolVar(&conf.allowAnonCreate, "allow-anon-create", true, "let users who never chose a name create tables")
+	flag.IntVar(&conf.maxBuyIn, "max-buy-in", 0, "max amount of a single re-buy, 0 is unlimited")
+	flag.BoolVar(&conf.provablyFair, "provably-fair", false, "commit to shuffle seeds and reveal them on the next shuffle")
+	flag.BoolVar(&conf.stackedDeck, "stacked-deck", false, "send the deck pile as a single item instead of individual cards")
+	flag.BoolVar(&conf.privateStacks, "private-stacks", false, "hide players stacks from opponents")
+	flag.IntVar(&conf.maxTables, "max-tables", 1000, "max number of tables, 0 is unlimited")
+	flag.IntVar(&conf.maxTablesPerUser, "max-tables-per-user", 10, "max number of tables a user can create, 0 is unlimited")
+	flag.DurationVar(&conf.tableTTL, "table-ttl", 24*time.Hour, "how long abandoned tables are kept")
+	flag.StringVar(&conf.anonPrefix, "anon-prefix", "Anon", "name prefix of auto generated users")
+	flag.StringVar(&conf.statePath, "state-path", statePath, "file to persist the state to")
+	flag.DurationVar(&conf.wsPingPeriod, "ws-ping", defaultWSPingPeriod, "how often web socket clients are pinged")
+	flag.DurationVar(&conf.idleKickAfter, "idle-kick-after", 0, "remove players offline and idle for this long, 0 disables it")
+	flag.DurationVar(&conf.idleKickWarning, "idle-kick-warning", 30*time.Second, "how long before removing an idle player the table gets warned")
+	flag.StringVar(&conf.adminToken, "admin-token", os.Getenv("ADMIN_TOKEN"), "bearer token of operator endpoints, empty disables them")
+	flag.StringVar(&conf.templatesPath, "templates", "", "JSON file with table templates, built-in ones are used if empty")
+	flag.DurationVar(&conf.saveDelay, "save-delay", 0, "also save the state this long after tables change, 0 disables it")
+	flag.BoolVar(&conf.wsCompression, "ws-compression", false, "compress web socket messages for clients supporting permessage-deflate")
+	flag.BoolVar(&conf.debug, "debug", false, "enable debug endpoints, never use in production")
+	flag.IntVar(&conf.maxCreatesPerMin, "max-creates-per-min", 10, "max number of tables a user can create in a minute, 0 is unlimited")
+	flag.IntVar(&conf.maxJoinsPerMin, "max-joins-per-min", 10, "max number of joins of a user in a minute, 0 is unlimited")
+	flag.IntVar(&conf.maxConnsPerUser, "max-conns-per-user", 5, "max number of web socket connections of a user, 0 is unlimited")
+	flag.IntVar(&conf.updatesBuffer, "updates-buffer", poker.DefaultUpdatesBuffer, "number of pushes buffered for each subscriber")
+	flag.BoolVar(&conf.noPersist, "no-persist", false, "keep the state in memory only")
+	flag.Parse()
+	httpx.SetErrorPage(errorPage)
+	if conf.templatesPath != "" {
+		if err := poker.LoadTemplates(conf.templatesPath); err != nil {
+			logger.Error.Printf("poker.LoadTemplates: %s; using built-in templates", err)
+		}
+	}
+	if conf.wsPingPeriod < minWSPingPeriod {
+		dieIf(fmt.Errorf("-ws-ping must be at least %s: %s", minWSPingPeriod, conf.wsPingPeriod))
+	}
+	if conf.updatesBuffer < 1 {
+		dieIf(fmt.Errorf("-updates-buffer must be positive: %d", conf.updatesBuffer))
+	}
+	if !usernameValidator.MatchString(conf.anonPrefix) {
+		dieIf(fmt.Errorf("invalid characters in -anon-prefix: %s", conf.anonPrefix))
+	}
+
+	s := newServer(conf)
+	if err := s.loadState(); err != nil {
+		logger.Error.Printf("server.loadState %s", err)
+	}
+
 	go handleSignalsLoop(s)
 	go saveStateLoop(s)
+	if conf.saveDelay > 0 {
+		go autoSaveLoop(s, conf.saveDelay)
+	}
+	go pruneUsersLoop(s)
+	go reapTablesLoop(s)
+	go releaseGrabsLoop(s)
+	if conf.idleKickAfter > 0 {
+		go kickIdlePlayersLoop(s)
+	}
 
+	logger.Info.Printf("version=%s commit=%s", version, commit)
 	logger.Info.Printf("Start listening on %s", s.endpoint)
-	must(http.ListenAndServe(s.endpoint, nil))
+	must(http.ListenAndServe(s.endpoint, s.routes()))
 }
 
 func must(err error) {
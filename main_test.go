@@ -0,0 +1,1573 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/nchern/vpoker/pkg/logger"
+	"github.com/nchern/vpoker/pkg/poker"
+)
+
+// pushWait limits how long tests wait for an expected push
+const pushWait = 5 * time.Second
+
+// testConfig is a config of a server keeping the state in memory without optional limits
+func testConfig() config {
+	return config{
+		buyIn:           poker.DefaultBuyIn,
+		anonPrefix:      "Anon",
+		wsPingPeriod:    defaultWSPingPeriod,
+		updatesBuffer:   poker.DefaultUpdatesBuffer,
+		allowAnonCreate: true,
+		noPersist:       true,
+	}
+}
+
+// testClock is a clock tests move by hand
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// newTestClock starts at the wall time as cookies expire by it
+func newTestClock() *testClock {
+	return &testClock{now: time.Now().UTC()}
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// testServer is a server listening on an ephemeral port
+type testServer struct {
+	*server
+
+	http *httptest.Server
+}
+
+func startTestServer(t *testing.T, conf config) *testServer {
+	t.Helper()
+	s := newServer(conf)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+	return &testServer{server: s, http: ts}
+}
+
+// testClient is a browser of a single user: it keeps the session cookie
+// and does not follow redirects so that tests can check them
+type testClient struct {
+	t      *testing.T
+	srv    *testServer
+	http   *http.Client
+	userID uuid.UUID
+}
+
+// newClient registers a new user and captures its session cookie
+func (ts *testServer) newClient(t *testing.T) *testClient {
+	t.Helper()
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{
+		t:   t,
+		srv: ts,
+		http: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	resp, _ := c.do("GET", "/users/new", nil)
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("/users/new: status %d", resp.StatusCode)
+	}
+	u, _ := url.Parse(ts.http.URL)
+	for _, it := range jar.Cookies(u) {
+		if it.Name != "session" {
+			continue
+		}
+		sess := &session{}
+		if err := sess.parseFromCookie(it.Value); err != nil {
+			t.Fatal(err)
+		}
+		c.userID = sess.UserID
+	}
+	if c.userID == uuid.Nil {
+		t.Fatal("/users/new: no session cookie")
+	}
+	return c
+}
+
+// do sends a request with a JSON body unless it is nil and returns the response with its body read
+func (c *testClient) do(method string, path string, body any) (*http.Response, []byte) {
+	c.t.Helper()
+	return c.doWithHeader(method, path, body, nil)
+}
+
+func (c *testClient) doWithHeader(method string, path string, body any, header http.Header) (*http.Response, []byte) {
+	c.t.Helper()
+	var rd io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		rd = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, c.srv.http.URL+path, rd)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return resp, b
+}
+
+// call sends a request and decodes its JSON response into out unless it is nil. Returns the status code
+func (c *testClient) call(method string, path string, body any, out any) int {
+	c.t.Helper()
+	resp, b := c.do(method, path, body)
+	if out != nil && resp.StatusCode < 300 {
+		if err := json.Unmarshal(b, out); err != nil {
+			c.t.Fatalf("%s %s: %s: %s", method, path, err, b)
+		}
+	}
+	return resp.StatusCode
+}
+
+// mustCall is call failing the test unless the response is 200
+func (c *testClient) mustCall(method string, path string, body any, out any) {
+	c.t.Helper()
+	resp, b := c.do(method, path, body)
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("%s %s: status %d %s", method, path, resp.StatusCode, b)
+	}
+	if out != nil {
+		if err := json.Unmarshal(b, out); err != nil {
+			c.t.Fatalf("%s %s: %s: %s", method, path, err, b)
+		}
+	}
+}
+
+// createTable creates a table with given query parameters, the creator sits at it
+func (c *testClient) createTable(query string) uuid.UUID {
+	c.t.Helper()
+	resp, b := c.do("GET", "/games/new?"+query, nil)
+	loc := resp.Header.Get("Location")
+	if resp.StatusCode != http.StatusFound || !strings.HasPrefix(loc, "/games/") {
+		c.t.Fatalf("/games/new: status %d location %q %s", resp.StatusCode, loc, b)
+	}
+	id, err := uuid.Parse(strings.TrimPrefix(loc, "/games/"))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return id
+}
+
+func (c *testClient) join(id uuid.UUID) *poker.Player {
+	c.t.Helper()
+	p := &poker.Player{}
+	c.mustCall("GET", tablePath(id, "join"), nil, p)
+	return p
+}
+
+func (c *testClient) state(id uuid.UUID) *TableState {
+	c.t.Helper()
+	// the embedded table decodes the whole object, so the rest is decoded separately
+	var st struct {
+		Layout *poker.Layout `json:"layout"`
+		Seats  []uuid.UUID   `json:"seats"`
+	}
+	table := &poker.Table{}
+	resp, b := c.do("GET", tablePath(id, "state"), nil)
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("state: status %d %s", resp.StatusCode, b)
+	}
+	if err := json.Unmarshal(b, &st); err != nil {
+		c.t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, table); err != nil {
+		c.t.Fatal(err)
+	}
+	return &TableState{Table: table, Layout: st.Layout, Seats: st.Seats}
+}
+
+// listen opens a push connection to a table
+func (c *testClient) listen(id uuid.UUID) *websocket.Conn {
+	c.t.Helper()
+	u := "ws" + strings.TrimPrefix(c.srv.http.URL, "http") + tablePath(id, "listen")
+	dialer := &websocket.Dialer{Jar: c.http.Jar, HandshakeTimeout: pushWait}
+	conn, resp, err := dialer.Dial(u, nil)
+	if err != nil {
+		c.t.Fatalf("dial %s: %s %v", u, err, resp)
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func tablePath(id uuid.UUID, action string) string {
+	return "/games/" + id.String() + "/" + action
+}
+
+// waitPush reads pushes until one of a given type arrives
+func waitPush(t *testing.T, conn *websocket.Conn, typ poker.PushType) *poker.Push {
+	t.Helper()
+	if err := conn.SetReadDeadline(time.Now().Add(pushWait)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		push := &poker.Push{}
+		if err := conn.ReadJSON(push); err != nil {
+			t.Fatalf("waiting for %s push: %s", typ, err)
+		}
+		if push.Type == typ {
+			return push
+		}
+	}
+}
+
+// deckTop returns the top card of the deck pile as a given state shows it
+func deckTop(st *TableState) *poker.TableItem {
+	var top *poker.TableItem
+	for _, it := range st.Items {
+		if it.Is(poker.CardClass) && !it.IsOwned() && it.Side == poker.Cover &&
+			it.Y == st.DeckY && (top == nil || it.X > top.X) {
+			top = it
+		}
+	}
+	return top
+}
+
+func findItem(st *TableState, cls poker.Class) *poker.TableItem {
+	for _, it := range st.Items {
+		if it.Is(cls) {
+			return it
+		}
+	}
+	return nil
+}
+
+func TestServerEndToEnd(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+
+	id := alice.createTable("")
+	pushes := alice.listen(id)
+
+	joined := bob.join(id)
+	if joined.ID != bob.userID {
+		t.Fatalf("joined as %s, expected %s", joined.ID, bob.userID)
+	}
+	if push := waitPush(t, pushes, poker.PlayerJoined); push.Players[bob.userID] == nil {
+		t.Fatalf("bob is missing in the joined push: %+v", push.Players)
+	}
+
+	st := bob.state(id)
+	dealer := findItem(st, poker.DealerClass)
+	req := map[string]any{
+		"id": dealer.ID, "class": dealer.Class, "x": dealer.X + 10, "y": dealer.Y + 10,
+		"side": dealer.Side, "color": dealer.Color, "val": dealer.Val,
+	}
+	bob.mustCall("POST", tablePath(id, "update"), req, nil)
+	moved := waitPush(t, pushes, poker.UpdateItems)
+	if len(moved.Items) != 1 || moved.Items[0].ID != dealer.ID || moved.Items[0].X != dealer.X+10 {
+		t.Fatalf("unexpected move push: %+v", moved.Items)
+	}
+
+	top := deckTop(st)
+	taken := &ItemUpdatedResponse{}
+	bob.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": top.ID}, taken)
+	if taken.Updated.Rank == "" {
+		t.Fatal("the taker must see the taken card")
+	}
+	push := waitPush(t, pushes, poker.UpdateItems)
+	if push.Action != poker.Taken || push.Items[0].OwnerID != bob.userID.String() {
+		t.Fatalf("unexpected take push: %+v", push)
+	}
+	if push.Items[0].Rank != "" || push.Items[0].Suit != poker.BlankSuit {
+		t.Fatalf("others must not see a taken card: %+v", push.Items[0])
+	}
+
+	if code := bob.call("GET", tablePath(id, "shuffle"), nil, nil); code != http.StatusFound {
+		t.Fatalf("shuffle: status %d", code)
+	}
+	waitPush(t, pushes, poker.Refresh)
+}
+
+// table returns a copy of a table as it is on the server, unaffected by visibility rules
+func (ts *testServer) table(t *testing.T, id uuid.UUID) *poker.Table {
+	t.Helper()
+	table, found := ts.tables.Get(id)
+	if !found {
+		t.Fatalf("table %s not found", id)
+	}
+	var res *poker.Table
+	if err := table.ReadLock(context.Background(), func(t *poker.Table) error {
+		var err error
+		res, err = t.DeepCopy()
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+// player returns a copy of a player at a given table
+func (ts *testServer) player(t *testing.T, tableID uuid.UUID, userID uuid.UUID) *poker.Player {
+	t.Helper()
+	table, found := ts.tables.Get(tableID)
+	if !found {
+		t.Fatalf("table %s not found", tableID)
+	}
+	var res *poker.Player
+	if err := table.ReadLock(context.Background(), func(t *poker.Table) error {
+		if p := t.Players[userID]; p != nil {
+			cp := *p
+			res = &cp
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestLoadStateLinksPlayersToUsers(t *testing.T) {
+	clock := newTestClock()
+	srv := startTestServer(t, testConfig())
+	srv.clock = clock
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+
+	if err := srv.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * lastSeenThrottle)
+	alice.state(id)
+
+	if seen := srv.player(t, id, alice.userID).SeenAt(); !seen.Equal(clock.Now()) {
+		t.Fatalf("the player must see the activity after a restart, seen at %s", seen)
+	}
+}
+
+func TestGrabDoesNotRevealOpponentsCard(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+
+	card := deckTop(bob.state(id))
+	bob.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, nil)
+
+	grabbed := &poker.Push{}
+	alice.mustCall("POST", tablePath(id, "grab"), map[string]int{"id": card.ID}, grabbed)
+	if it := grabbed.Items[0]; it.Rank != "" || it.Suit != poker.BlankSuit || it.Side != poker.Cover {
+		t.Fatalf("grab revealed the card of an opponent: %+v", it)
+	}
+	released := &poker.Push{}
+	alice.mustCall("POST", tablePath(id, "release"), map[string]int{"id": card.ID}, released)
+	if it := released.Items[0]; it.Rank != "" || it.Suit != poker.BlankSuit {
+		t.Fatalf("release revealed the card of an opponent: %+v", it)
+	}
+}
+
+func TestExpiredGrabIsReleased(t *testing.T) {
+	clock := newTestClock()
+	srv := startTestServer(t, testConfig())
+	srv.clock = clock
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	pushes := bob.listen(id)
+
+	dealer := findItem(alice.state(id), poker.DealerClass)
+	alice.mustCall("POST", tablePath(id, "grab"), map[string]int{"id": dealer.ID}, nil)
+	if grabbed := waitPush(t, pushes, poker.UpdateItems); grabbed.Items[0].GrabbedBy != alice.userID.String() {
+		t.Fatalf("grab is not pushed: %+v", grabbed.Items[0])
+	}
+
+	if n := srv.releaseExpiredGrabs(clock.Now()); n != 0 {
+		t.Fatalf("%d grabs released before they expired", n)
+	}
+	clock.Advance(poker.GrabTTL)
+	if n := srv.releaseExpiredGrabs(clock.Now()); n != 1 {
+		t.Fatalf("%d grabs released, expected 1", n)
+	}
+	released := waitPush(t, pushes, poker.UpdateItems)
+	if released.Items[0].ID != dealer.ID || released.Items[0].GrabbedBy != "" {
+		t.Fatalf("release is not pushed: %+v", released.Items[0])
+	}
+	if n := srv.releaseExpiredGrabs(clock.Now()); n != 0 {
+		t.Fatalf("%d grabs released twice", n)
+	}
+}
+
+func TestHiddenStackIsNotSentToOpponents(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	pushes := bob.listen(id)
+
+	own := &poker.Push{}
+	alice.mustCall("POST", tablePath(id, "hide_stack"), map[string]bool{"hide": true}, own)
+	if st := own.Economy.Stacks[alice.userID]; st.Amount != poker.DefaultBuyIn || !st.Hidden {
+		t.Fatalf("the owner must see the own hidden stack: %+v", st)
+	}
+
+	push := waitPush(t, pushes, poker.EconomyChanged)
+	if st := push.Economy.Stacks[alice.userID]; st.Amount != 0 || !st.Hidden {
+		t.Fatalf("opponents got a hidden stack: %+v", st)
+	}
+	if st := push.Economy.Stacks[bob.userID]; st.Amount != poker.DefaultBuyIn {
+		t.Fatalf("an opponent must see the own stack: %+v", st)
+	}
+	if p := bob.state(id).Players[alice.userID]; p.Stack != 0 {
+		t.Fatalf("the table state shows a hidden stack to opponents: %d", p.Stack)
+	}
+	if p := alice.state(id).Players[alice.userID]; p.Stack != poker.DefaultBuyIn {
+		t.Fatalf("the table state hides the stack from its owner: %d", p.Stack)
+	}
+}
+
+// isBlank checks if a card does not show its rank and suit
+func isBlank(it *poker.TableItem) bool {
+	return it.Side == poker.Cover && it.Rank == "" && it.Suit == poker.BlankSuit
+}
+
+func TestFoldedCardsStayHidden(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	pushes := alice.listen(id)
+
+	card := deckTop(bob.state(id))
+	own := &ItemUpdatedResponse{}
+	bob.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, own)
+	taken := &ItemUpdatedResponse{}
+	alice.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, taken)
+	if !isBlank(taken.Updated) {
+		t.Fatalf("taking an opponent's card revealed it: %+v", taken.Updated)
+	}
+
+	bob.mustCall("POST", tablePath(id, "fold"), nil, nil)
+	folded := waitPush(t, pushes, poker.PlayerFolded)
+	if len(folded.Items) != 1 || !isBlank(folded.Items[0]) || !folded.Items[0].Mucked {
+		t.Fatalf("the fold push revealed a mucked card: %+v", folded.Items)
+	}
+	if it := alice.state(id).Items.Get(card.ID); !isBlank(it) {
+		t.Fatalf("the table state revealed a mucked card: %+v", it)
+	}
+	resp, b := alice.do("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID})
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("taking a mucked card: status %d %s", resp.StatusCode, b)
+	}
+	if strings.Contains(string(b), string(own.Updated.Suit)) {
+		t.Fatalf("the rejection revealed the card: %s", b)
+	}
+}
+
+func TestTablesCap(t *testing.T) {
+	conf := testConfig()
+	conf.maxTables = 2
+	conf.maxTablesPerUser = 1
+	srv := startTestServer(t, conf)
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	carol := srv.newClient(t)
+	rejected := metricTablesRejected.Load()
+
+	alice.createTable("")
+	if resp, b := alice.do("GET", "/games/new", nil); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("the per user cap: status %d %s", resp.StatusCode, b)
+	}
+	bob.createTable("")
+	if resp, b := carol.do("GET", "/games/new", nil); resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("the global cap: status %d %s", resp.StatusCode, b)
+	}
+	if n := metricTablesRejected.Load() - rejected; n != 2 {
+		t.Fatalf("%d rejections counted, expected 2", n)
+	}
+}
+
+func TestReapTablesAfterRestart(t *testing.T) {
+	clock := newTestClock()
+	conf := testConfig()
+	conf.tableTTL = time.Hour
+	srv := startTestServer(t, conf)
+	srv.clock = clock
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	played := alice.createTable("")
+	abandoned := bob.createTable("")
+
+	if err := srv.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(50 * time.Minute)
+	alice.state(played)
+	clock.Advance(20 * time.Minute)
+
+	if n := srv.reapTables(clock.Now()); n != 1 {
+		t.Fatalf("%d tables reaped, expected 1", n)
+	}
+	if _, found := srv.tables.Get(abandoned); found {
+		t.Fatal("the abandoned table is kept")
+	}
+	if _, found := srv.tables.Get(played); !found {
+		t.Fatal("the table being played is reaped")
+	}
+
+	alice.listen(played)
+	clock.Advance(2 * conf.tableTTL)
+	if n := srv.reapTables(clock.Now()); n != 0 {
+		t.Fatalf("a table with a connected player is reaped")
+	}
+}
+
+func TestMetricsRequireAdmin(t *testing.T) {
+	conf := testConfig()
+	conf.adminToken = "secret"
+	srv := startTestServer(t, conf)
+
+	get := func(token string) (int, map[string]any) {
+		req, err := http.NewRequest("GET", srv.http.URL+"/debug/vars", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		vars := map[string]any{}
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, vars
+	}
+
+	if code, _ := get(""); code != http.StatusUnauthorized {
+		t.Fatalf("anonymous access: status %d", code)
+	}
+	code, vars := get("secret")
+	if code != http.StatusOK {
+		t.Fatalf("admin access: status %d", code)
+	}
+	expected := []string{"tables_created", "tables_rejected", "tables_reaped", "ws_connections"}
+	for _, k := range expected {
+		if _, found := vars[k]; !found {
+			t.Fatalf("%s is missing: %v", k, vars)
+		}
+	}
+	if len(vars) != len(expected) {
+		t.Fatalf("unexpected vars are exposed: %v", vars)
+	}
+}
+
+func TestDeleteSeatedUser(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	card := deckTop(bob.state(id))
+	bob.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, nil)
+	bobPushes := bob.listen(id)
+	alicePushes := alice.listen(id)
+	u, _ := url.Parse(srv.http.URL)
+	cookies := bob.http.Jar.Cookies(u)
+
+	bob.mustCall("POST", "/users/delete", nil, nil)
+
+	if push := waitPush(t, bobPushes, poker.Disconnected); push.Reason != poker.Kicked {
+		t.Fatalf("unexpected disconnect reason: %s", push.Reason)
+	}
+	waitPush(t, alicePushes, poker.Refresh)
+	if _, found := srv.users.Get(bob.userID); found {
+		t.Fatal("the user is kept")
+	}
+	if srv.player(t, id, bob.userID) != nil {
+		t.Fatal("the table keeps a player of the deleted user")
+	}
+	st := alice.state(id)
+	if _, found := st.Players[bob.userID]; found {
+		t.Fatal("the state shows a player of the deleted user")
+	}
+	if it := st.Items.Get(card.ID); it.IsOwned() {
+		t.Fatalf("the card of the deleted user is not returned: %+v", it)
+	}
+	for _, it := range st.Items {
+		if it.IsOwnedBy(bob.userID) {
+			t.Fatalf("an item still belongs to the deleted user: %+v", it)
+		}
+	}
+	if resp, _ := bob.do("POST", "/users/delete", nil); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("deleting without a session: status %d", resp.StatusCode)
+	}
+
+	// the old cookie may still be sent, e.g. by another tab
+	bob.http.Jar.SetCookies(u, cookies)
+	bob.mustCall("POST", "/users/delete", nil, nil)
+}
+
+func TestJoinReturnsAssignedSeat(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	colors := map[poker.Color]bool{}
+	for _, c := range poker.PlayerColors() {
+		colors[c] = true
+	}
+	seen := map[poker.Color]bool{srv.player(t, id, alice.userID).Color: true}
+	for i := 1; i < maxPlayers; i++ {
+		c := srv.newClient(t)
+		p := c.join(id)
+		if !colors[p.Color] {
+			t.Fatalf("%s is not a player color", p.Color)
+		}
+		if seen[p.Color] {
+			t.Fatalf("%s is assigned twice", p.Color)
+		}
+		seen[p.Color] = true
+		if actual := srv.player(t, id, c.userID); actual.Index != p.Index || actual.Color != p.Color {
+			t.Fatalf("the join response %d %s differs from the seat %d %s", p.Index, p.Color, actual.Index, actual.Color)
+		}
+	}
+
+	// a browser of a seated player goes to the table
+	req, err := http.NewRequest("GET", srv.http.URL+tablePath(id, "join"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := alice.http.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/games/"+id.String() {
+		t.Fatalf("browsers must be redirected to the table: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestUnknownFieldsAreRejected(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	dealer := findItem(alice.state(id), poker.DealerClass)
+
+	var tests = []struct {
+		name   string
+		action string
+		field  string
+		body   map[string]any
+	}{
+		{"misspelled id", "take_card", "idd", map[string]any{"idd": 1}},
+		{"extra field", "show_card", "side", map[string]any{"id": 1, "side": "face"}},
+		{"misspelled coordinate", "update", "xx",
+			map[string]any{"id": dealer.ID, "class": dealer.Class, "xx": 10, "y": dealer.Y}},
+		{"unknown item field", "update", "owner",
+			map[string]any{"id": dealer.ID, "class": dealer.Class, "x": 10, "y": dealer.Y, "owner": "me"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, b := alice.do("POST", tablePath(id, tt.action), tt.body)
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("status %d %s", resp.StatusCode, b)
+			}
+			if !strings.Contains(string(b), `\"`+tt.field+`\"`) {
+				t.Fatalf("the error does not tell the bad field %s: %s", tt.field, b)
+			}
+		})
+	}
+	if resp, b := alice.do("POST", tablePath(id, "take_card"), map[string]any{}); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("missing id: status %d %s", resp.StatusCode, b)
+	}
+	if it := alice.state(id).Items.Get(dealer.ID); it.X != dealer.X {
+		t.Fatalf("a rejected update moved the dealer: %+v", it)
+	}
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	key := http.Header{idempotencyHeader: []string{"retry-1"}}
+	bet := map[string]int{"amount": 10}
+
+	resp, first := alice.doWithHeader("POST", tablePath(id, "bet"), bet, key)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("bet: status %d %s", resp.StatusCode, first)
+	}
+	_, replayed := alice.doWithHeader("POST", tablePath(id, "bet"), bet, key)
+	if string(first) != string(replayed) {
+		t.Fatalf("a replay must return the original response:\n%s\n%s", first, replayed)
+	}
+	if p := srv.player(t, id, alice.userID); p.Stack != poker.DefaultBuyIn-10 {
+		t.Fatalf("a replayed bet is applied twice: stack %d", p.Stack)
+	}
+
+	// the same key on another endpoint is another request
+	card := deckTop(alice.state(id))
+	taken := &ItemUpdatedResponse{}
+	resp, b := alice.doWithHeader("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, key)
+	if resp.StatusCode != http.StatusOK || json.Unmarshal(b, taken) != nil || taken.Updated == nil {
+		t.Fatalf("take_card got a cached response of another endpoint: %d %s", resp.StatusCode, b)
+	}
+	if taken.Updated.ID != card.ID || !taken.Updated.IsOwnedBy(alice.userID) {
+		t.Fatalf("the card is not taken: %+v", taken.Updated)
+	}
+
+	alice.doWithHeader("POST", tablePath(id, "bet"), bet, http.Header{idempotencyHeader: []string{"retry-2"}})
+	if p := srv.player(t, id, alice.userID); p.Stack != poker.DefaultBuyIn-20 {
+		t.Fatalf("a bet with a new key is not applied: stack %d", p.Stack)
+	}
+}
+
+func TestStateSeatsAreStable(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	expected := []uuid.UUID{alice.userID}
+	for i := 1; i < maxPlayers; i++ {
+		c := srv.newClient(t)
+		c.join(id)
+		expected = append(expected, c.userID)
+	}
+	for i := 0; i < 20; i++ {
+		st := alice.state(id)
+		if len(st.Seats) != len(expected) {
+			t.Fatalf("seats %v, expected %v", st.Seats, expected)
+		}
+		for j, seat := range st.Seats {
+			if seat != expected[j] || st.Players[seat].Index != j {
+				t.Fatalf("request %d: seats %v, expected %v", i, st.Seats, expected)
+			}
+		}
+	}
+}
+
+func TestListTablesFilters(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	friday := alice.createTable("name=Friday+Night")
+	sunday := alice.createTable("name=Sunday")
+	bobs := bob.createTable("name=friday+rematch")
+	aliceUser, _ := srv.users.Get(alice.userID)
+
+	var tests = []struct {
+		name     string
+		query    string
+		expected []uuid.UUID
+	}{
+		{"no filter", "", []uuid.UUID{friday, sunday, bobs}},
+		{"name is case insensitive", "q=FRIDAY", []uuid.UUID{friday, bobs}},
+		{"name substring", "q=nig", []uuid.UUID{friday}},
+		{"creator id", "creator=" + bob.userID.String(), []uuid.UUID{bobs}},
+		{"creator name", "creator=" + url.QueryEscape(aliceUser.Name), []uuid.UUID{friday, sunday}},
+		{"creator name is exact", "creator=" + url.QueryEscape(aliceUser.Name[1:]), nil},
+		{"both", "q=friday&creator=" + alice.userID.String(), []uuid.UUID{friday}},
+		{"nothing found", "q=saturday", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res []*TableSummary
+			bob.mustCall("GET", "/games?"+tt.query, nil, &res)
+			actual := map[uuid.UUID]bool{}
+			for _, it := range res {
+				actual[it.ID] = true
+			}
+			if len(actual) != len(tt.expected) {
+				t.Fatalf("expected %v, actual %v", tt.expected, actual)
+			}
+			for _, id := range tt.expected {
+				if !actual[id] {
+					t.Fatalf("expected %v, actual %v", tt.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestListenRequiresMembership(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	stranger := srv.newClient(t)
+	id := alice.createTable("")
+
+	alice.listen(id) // a member gets updates
+
+	dial := func(c *testClient, path string) (int, string) {
+		u := "ws" + strings.TrimPrefix(srv.http.URL, "http") + path
+		dialer := &websocket.Dialer{Jar: c.http.Jar, HandshakeTimeout: pushWait}
+		conn, resp, err := dialer.Dial(u, nil)
+		if err == nil {
+			conn.Close()
+			t.Fatalf("%s: a connection is upgraded", path)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(b)
+	}
+	if code, body := dial(stranger, tablePath(id, "listen")); code != http.StatusForbidden || !strings.Contains(body, "join") {
+		t.Fatalf("a non-member: status %d %s", code, body)
+	}
+	unknown, _ := dial(stranger, tablePath(uuid.New(), "listen"))
+	malformed, _ := dial(stranger, "/games/not-an-id/listen")
+	if unknown != http.StatusNotFound || malformed != unknown {
+		t.Fatalf("unknown tables must look the same: unknown %d malformed %d", unknown, malformed)
+	}
+
+	resp, _ := stranger.do("GET", tablePath(id, "listen"), nil)
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/games/"+id.String() {
+		t.Fatalf("a browser must be sent to the table page: %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestKickIdlePlayers(t *testing.T) {
+	clock := newTestClock()
+	conf := testConfig()
+	conf.idleKickAfter = time.Minute
+	conf.idleKickWarning = 30 * time.Second
+	srv := startTestServer(t, conf)
+	srv.clock = clock
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	carol := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	carol.join(id)
+	pushes := alice.listen(id)
+	table, _ := srv.tables.Get(id)
+
+	// nobody is idle: the check must not wait for the write lock
+	checked := make(chan int)
+	if err := table.ReadLock(context.Background(), func(*poker.Table) error {
+		go func() { checked <- srv.kickIdlePlayers(clock.Now()) }()
+		select {
+		case n := <-checked:
+			if n != 0 {
+				t.Errorf("%d players kicked", n)
+			}
+		case <-time.After(pushWait):
+			t.Error("the check of a table without idle players takes its write lock")
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(2 * conf.idleKickAfter)
+	if n := srv.kickIdlePlayers(clock.Now()); n != 0 {
+		t.Fatalf("%d players kicked without a warning", n)
+	}
+	warned := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		warned[strings.Fields(waitPush(t, pushes, poker.PlayerIdle).Message)[0]] = true
+	}
+	for _, c := range []*testClient{bob, carol} {
+		if u, _ := srv.users.Get(c.userID); !warned[u.Name] {
+			t.Fatalf("%s is not warned: %v", u.Name, warned)
+		}
+	}
+
+	clock.Advance(conf.idleKickWarning - time.Second)
+	carol.state(id) // any activity after the warning keeps a player
+	clock.Advance(time.Second)
+	if n := srv.kickIdlePlayers(clock.Now()); n != 1 {
+		t.Fatalf("%d players kicked, expected 1", n)
+	}
+	waitPush(t, pushes, poker.Refresh)
+	if srv.player(t, id, bob.userID) != nil {
+		t.Fatal("bob is still at the table")
+	}
+	if srv.player(t, id, carol.userID) == nil || srv.player(t, id, alice.userID) == nil {
+		t.Fatal("an active player is kicked")
+	}
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	prev := logger.GetLevel()
+	t.Cleanup(func() { logger.SetLevel(prev) })
+	conf := testConfig()
+	conf.adminToken = "secret"
+	srv := startTestServer(t, conf)
+	c := srv.newClient(t)
+	admin := http.Header{"Authorization": []string{"Bearer secret"}}
+
+	if resp, _ := c.do("POST", "/admin/loglevel", map[string]string{"level": "debug"}); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("no token: status %d", resp.StatusCode)
+	}
+	if logger.GetLevel() != prev {
+		t.Fatal("the level is changed without a token")
+	}
+	for _, level := range []logger.Level{logger.DebugLevel, logger.ErrorLevel} {
+		resp, b := c.doWithHeader("POST", "/admin/loglevel", map[string]string{"level": level.String()}, admin)
+		if resp.StatusCode != http.StatusOK || logger.GetLevel() != level {
+			t.Fatalf("%s: status %d %s, level %s", level, resp.StatusCode, b, logger.GetLevel())
+		}
+	}
+	if resp, _ := c.doWithHeader("POST", "/admin/loglevel", map[string]string{"level": "loud"}, admin); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("an unknown level: status %d", resp.StatusCode)
+	}
+}
+
+func TestTableIDs(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+
+	var tests = []struct {
+		name     string
+		id       string
+		expected int
+	}{
+		{"known", id.String(), http.StatusOK},
+		{"unknown", uuid.New().String(), http.StatusNotFound},
+		{"malformed", "zzz-not-a-table", http.StatusNotFound},
+		{"too short", id.String()[1:], http.StatusNotFound},
+		{"markup", url.PathEscape("<b>" + id.String()), http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, b := alice.do("GET", "/games/"+tt.id+"/state", nil)
+			if resp.StatusCode != tt.expected {
+				t.Fatalf("status %d %s", resp.StatusCode, b)
+			}
+			if tt.expected != http.StatusOK && strings.Contains(string(b), tt.id[4:]) {
+				t.Fatalf("the id is echoed back: %s", b)
+			}
+		})
+	}
+}
+
+func TestStaleUpdateReturnsCurrentItem(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	stale := deckTop(alice.state(id))
+
+	// bob takes the card alice is about to move
+	bob.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": stale.ID}, nil)
+	req := map[string]any{
+		"id": stale.ID, "class": stale.Class, "x": stale.X + 100, "y": stale.Y + 100,
+		"side": stale.Side, "suit": stale.Suit, "rank": stale.Rank,
+		"owner_id": stale.OwnerID, "prev_owner_id": stale.PrevOwnerID,
+	}
+	resp, b := alice.do("POST", tablePath(id, "update"), req)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("status %d %s", resp.StatusCode, b)
+	}
+	conflict := &ConflictResponse{}
+	if err := json.Unmarshal(b, conflict); err != nil {
+		t.Fatalf("%s: %s", err, b)
+	}
+	cur := conflict.Current
+	if cur == nil || cur.ID != stale.ID || !cur.IsOwnedBy(bob.userID) || cur.X != stale.X {
+		t.Fatalf("the conflict does not carry the current item: %s", b)
+	}
+	if !isBlank(cur) {
+		t.Fatalf("the conflict revealed bob's card: %+v", cur)
+	}
+	if st := alice.state(id); conflict.Version != st.Version {
+		t.Fatalf("conflict version %d, table version %d", conflict.Version, st.Version)
+	}
+
+	// having reconciled, alice's update goes through
+	req["owner_id"], req["prev_owner_id"] = cur.OwnerID, cur.PrevOwnerID
+	if resp, b := alice.do("POST", tablePath(id, "update"), req); resp.StatusCode != http.StatusOK {
+		t.Fatalf("the reconciled update: status %d %s", resp.StatusCode, b)
+	}
+}
+
+func TestFlipMine(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	bob := srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	for i := 0; i < 2; i++ {
+		card := deckTop(bob.state(id))
+		bob.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, nil)
+	}
+	pushes := alice.listen(id)
+
+	for _, side := range []poker.Side{poker.Face, poker.Cover} {
+		own := &poker.Push{}
+		bob.mustCall("POST", tablePath(id, "flip_mine"), map[string]poker.Side{"side": side}, own)
+		if len(own.Items) != 2 {
+			t.Fatalf("%s: %d cards flipped", side, len(own.Items))
+		}
+		for _, it := range own.Items {
+			if it.Rank == "" {
+				t.Fatalf("%s: the owner must see the own cards: %+v", side, it)
+			}
+		}
+		push := waitPush(t, pushes, poker.UpdateItems)
+		if push.Action != poker.Flipped || len(push.Items) != 2 {
+			t.Fatalf("%s: unexpected push %+v", side, push)
+		}
+		for _, it := range push.Items {
+			if !isBlank(it) {
+				t.Fatalf("%s: others must see covers of owned cards: %+v", side, it)
+			}
+		}
+		for _, it := range srv.table(t, id).Items {
+			if it.Is(poker.CardClass) && it.IsOwnedBy(bob.userID) && it.Side != side {
+				t.Fatalf("card %d is %s, expected %s", it.ID, it.Side, side)
+			}
+		}
+	}
+}
+
+func TestCreateTableWithBank(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+
+	id := alice.createTable("bank=10,0,2,0,1") // 10*1 + 2*10 + 1*50
+	total := 0
+	for _, it := range alice.state(id).Items {
+		if it.Is(poker.ChipClass) {
+			total += it.Val
+		}
+	}
+	// the creator has joined with the buy-in on top of the bank
+	if expected := 80 + poker.DefaultBuyIn; total != expected {
+		t.Fatalf("the chips are worth %d, expected %d", total, expected)
+	}
+
+	if resp, b := alice.do("GET", "/games/new?bank=1,2,3", nil); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a bad bank: status %d %s", resp.StatusCode, b)
+	}
+}
+
+// countingConn counts bytes read from the wire
+type countingConn struct {
+	net.Conn
+
+	read atomic.Int64
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+// listenCounting opens a push connection offering compression or not,
+// it returns the counter of bytes received over it
+func (c *testClient) listenCounting(id uuid.UUID, compress bool) (*websocket.Conn, *countingConn) {
+	c.t.Helper()
+	var counter *countingConn
+	dialer := &websocket.Dialer{
+		Jar:               c.http.Jar,
+		HandshakeTimeout:  pushWait,
+		EnableCompression: compress,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			counter = &countingConn{Conn: conn}
+			return counter, nil
+		},
+	}
+	u := "ws" + strings.TrimPrefix(c.srv.http.URL, "http") + tablePath(id, "listen")
+	conn, resp, err := dialer.Dial(u, nil)
+	if err != nil {
+		c.t.Fatalf("dial %s: %s %v", u, err, resp)
+	}
+	c.t.Cleanup(func() { conn.Close() })
+	return conn, counter
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	conf := testConfig()
+	conf.wsCompression = true
+	srv := startTestServer(t, conf)
+	alice, bob, carol := srv.newClient(t), srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	carol.join(id)
+	compressed, compressedRead := bob.listenCounting(id, true)
+	plain, plainRead := carol.listenCounting(id, false)
+	compressedBefore, plainBefore := compressedRead.read.Load(), plainRead.read.Load()
+
+	alice.mustCall("POST", tablePath(id, "new_hand"), map[string]any{}, nil) // pushes all the cards
+
+	// both clients get the same snapshot, only its size on the wire differs
+	expected := waitPush(t, plain, poker.UpdateItems)
+	actual := waitPush(t, compressed, poker.UpdateItems)
+	if len(actual.Items) != len(expected.Items) || len(expected.Items) < 52 {
+		t.Fatalf("%d items pushed compressed, %d plain", len(actual.Items), len(expected.Items))
+	}
+	compressedN := compressedRead.read.Load() - compressedBefore
+	plainN := plainRead.read.Load() - plainBefore
+	t.Logf("new hand push: %d bytes compressed, %d bytes plain", compressedN, plainN)
+	if compressedN*2 > plainN {
+		t.Fatalf("compression saved too little: %d bytes instead of %d", compressedN, plainN)
+	}
+}
+
+// savesCounter is a Store signalling each save
+type savesCounter struct {
+	Store
+
+	saved chan struct{}
+}
+
+func (s *savesCounter) Save(marshalers ...json.Marshaler) error {
+	s.saved <- struct{}{}
+	return s.Store.Save(marshalers...)
+}
+
+func TestAutoSaveCoalescesChanges(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	srv := startTestServer(t, testConfig())
+	store := &savesCounter{Store: NewMemoryStore(), saved: make(chan struct{}, 100)}
+	srv.state = store
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	if err := srv.saveState(); err != nil {
+		t.Fatal(err)
+	}
+	<-store.saved
+	if err := srv.loadState(); err != nil { // loaded tables must signal changes too
+		t.Fatal(err)
+	}
+	select {
+	case <-srv.dirty: // a table creation is not tested here
+	default:
+	}
+	table, _ := srv.tables.Get(id)
+	go autoSaveLoop(srv.server, delay)
+
+	for i := 0; i < 20; i++ {
+		if err := table.Update(context.Background(), func(*poker.Table) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case <-store.saved:
+	case <-time.After(pushWait):
+		t.Fatal("the state is not saved after tables change")
+	}
+	select {
+	case <-store.saved:
+		t.Fatal("a burst of changes must be saved once")
+	case <-time.After(4 * delay):
+	}
+}
+
+func TestPruneUsersByRetentionClass(t *testing.T) {
+	clock := newTestClock()
+	conf := testConfig()
+	conf.userTTL = 30 * 24 * time.Hour
+	conf.anonTTL = time.Hour
+	srv := startTestServer(t, conf)
+	srv.clock = clock
+	anon, named, seated := srv.newClient(t), srv.newClient(t), srv.newClient(t)
+	named.setName("alice")
+	seated.createTable("")
+	exists := func(c *testClient) bool {
+		_, found := srv.users.Get(c.userID)
+		return found
+	}
+
+	clock.Advance(conf.anonTTL + time.Second)
+	if n := srv.pruneUsers(clock.Now()); n != 1 || exists(anon) {
+		t.Fatalf("%d users pruned, an idle anonymous user must be pruned after %s", n, conf.anonTTL)
+	}
+	if !exists(named) || !exists(seated) {
+		t.Fatal("a named user and a seated anonymous one must be kept")
+	}
+
+	clock.Advance(conf.userTTL)
+	if n := srv.pruneUsers(clock.Now()); n != 1 || exists(named) {
+		t.Fatalf("%d users pruned, an idle named user must be pruned after %s", n, conf.userTTL)
+	}
+	if !exists(seated) {
+		t.Fatal("a seated user must be kept")
+	}
+}
+
+func TestTakeCardUpToMaxHand(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("max_hand=2")
+	if st := alice.state(id); st.MaxHand != 2 {
+		t.Fatalf("max hand %d in the state", st.MaxHand)
+	}
+	take := func() int {
+		top := deckTop(alice.state(id))
+		return alice.call("POST", tablePath(id, "take_card"), map[string]int{"id": top.ID}, nil)
+	}
+
+	for i := 0; i < 2; i++ {
+		if code := take(); code != http.StatusOK {
+			t.Fatalf("card %d within the limit: status %d", i+1, code)
+		}
+	}
+	if code := take(); code != http.StatusConflict {
+		t.Fatalf("a card beyond the limit: status %d", code)
+	}
+	if p := srv.player(t, id, alice.userID); p.Cards != 2 {
+		t.Fatalf("alice holds %d cards", p.Cards)
+	}
+}
+
+func TestGiveCardUpToMaxHand(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice, bob := srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("max_hand=1")
+	bob.join(id)
+	give := func() (int, ItemUpdatedResponse) {
+		top := deckTop(alice.state(id))
+		resp, err := alice.http.PostForm(srv.http.URL+tablePath(id, "give_card"), url.Values{
+			"id":      {strconv.Itoa(top.ID)},
+			"user_id": {bob.userID.String()},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out ItemUpdatedResponse
+		if resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, out
+	}
+
+	code, out := give()
+	if code != http.StatusOK {
+		t.Fatalf("a card within the limit: status %d", code)
+	}
+	if !isBlank(out.Updated) {
+		t.Fatalf("the giver sees the given card %+v", out.Updated)
+	}
+	if code, _ := give(); code != http.StatusConflict {
+		t.Fatalf("a card beyond the limit: status %d", code)
+	}
+	if p := srv.player(t, id, bob.userID); p.Cards != 1 {
+		t.Fatalf("bob holds %d cards", p.Cards)
+	}
+}
+
+func TestActionsRequireMembership(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice, bob := srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("")
+	top := deckTop(alice.state(id))
+
+	var tests = []struct {
+		method string
+		action string
+		body   any
+	}{
+		{"GET", "state", nil},
+		{"POST", "update", map[string]any{"id": top.ID, "class": top.Class, "x": 1, "y": 1, "side": top.Side}},
+		{"POST", "take_card", map[string]int{"id": top.ID}},
+		{"POST", "show_card", map[string]int{"id": top.ID}},
+		{"GET", "shuffle", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.action, func(t *testing.T) {
+			resp, b := bob.do(tt.method, tablePath(id, tt.action), tt.body)
+			if resp.StatusCode != http.StatusForbidden || !strings.Contains(string(b), poker.ErrNotMember.Error()) {
+				t.Fatalf("status %d %s", resp.StatusCode, b)
+			}
+		})
+	}
+}
+
+func TestUnrevealWindow(t *testing.T) {
+	clock := newTestClock()
+	srv := startTestServer(t, testConfig())
+	srv.clock = clock
+	alice, bob := srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	card := deckTop(alice.state(id))
+	alice.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}, nil)
+	show := func() {
+		shown := &ItemUpdatedResponse{}
+		alice.mustCall("POST", tablePath(id, "show_card"), map[string]int{"id": card.ID}, shown)
+		if shown.Updated.ShownAt == nil || !shown.Updated.ShownAt.Equal(clock.Now()) {
+			t.Fatalf("shown at %v, expected %s", shown.Updated.ShownAt, clock.Now())
+		}
+	}
+	unreveal := func(c *testClient) (int, *poker.TableItem) {
+		resp := &ItemUpdatedResponse{}
+		code := c.call("POST", tablePath(id, "unreveal"), map[string]int{"id": card.ID}, resp)
+		return code, resp.Updated
+	}
+
+	show()
+	clock.Advance(poker.UnrevealWindow - time.Millisecond)
+	if code, _ := unreveal(bob); code != http.StatusForbidden {
+		t.Fatalf("only the revealer may take a card back: status %d", code)
+	}
+	code, updated := unreveal(alice)
+	if code != http.StatusOK {
+		t.Fatalf("just within the window: status %d", code)
+	}
+	if updated.OwnerID != alice.userID.String() || updated.Side != poker.Cover || updated.ShownAt != nil {
+		t.Fatalf("the card is not taken back: %+v", updated)
+	}
+
+	show()
+	clock.Advance(poker.UnrevealWindow)
+	if code, _ := unreveal(alice); code != http.StatusConflict {
+		t.Fatalf("at the end of the window: status %d", code)
+	}
+	if it := srv.table(t, id).Items.Get(card.ID); it.IsOwned() || it.Side != poker.Face {
+		t.Fatalf("a reveal must be final after the window: %+v", it)
+	}
+}
+
+// setName chooses a name of a user like the profile form does
+func (c *testClient) setName(name string) {
+	c.t.Helper()
+	resp, err := c.http.PostForm(c.srv.http.URL+"/users/profile", url.Values{"user_name": {name}})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		c.t.Fatalf("/users/profile: status %d", resp.StatusCode)
+	}
+}
+
+func TestAnonCreate(t *testing.T) {
+	for _, allowed := range []bool{true, false} {
+		conf := testConfig()
+		conf.allowAnonCreate = allowed
+		srv := startTestServer(t, conf)
+		anon, named := srv.newClient(t), srv.newClient(t)
+		named.setName("alice")
+
+		id := named.createTable("")
+		resp, b := anon.do("GET", "/games/new?max_hand=2", nil)
+		loc := resp.Header.Get("Location")
+		if allowed && !strings.HasPrefix(loc, "/games/") {
+			t.Fatalf("anonymous users are allowed to create tables: status %d location %q %s", resp.StatusCode, loc, b)
+		}
+		expected := "/users/profile?ret_path=" + url.QueryEscape("/games/new?max_hand=2")
+		if !allowed && loc != expected {
+			t.Fatalf("expected a redirect to %q, actual status %d location %q", expected, resp.StatusCode, loc)
+		}
+		anon.join(id) // joins stay open in both modes
+	}
+}
+
+func TestOpponentsSeeCardCountsOnly(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice, bob := srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	taken := map[int]bool{}
+	for i := 0; i < 2; i++ {
+		top := deckTop(alice.state(id))
+		alice.mustCall("POST", tablePath(id, "take_card"), map[string]int{"id": top.ID}, nil)
+		taken[top.ID] = true
+	}
+
+	st := bob.state(id)
+
+	if p := st.Players[alice.userID]; p == nil || p.Cards != 2 {
+		t.Fatalf("bob must see alice holds 2 cards: %+v", p)
+	}
+	if p := st.Players[bob.userID]; p.Cards != 0 {
+		t.Fatalf("bob holds %d cards", p.Cards)
+	}
+	for _, it := range st.Items {
+		if taken[it.ID] && !isBlank(it) {
+			t.Fatalf("alice's card leaks to bob: %+v", it)
+		}
+	}
+}
+
+func TestUpdateRejectsUnknownSide(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	top := deckTop(alice.state(id))
+	req := map[string]any{"id": top.ID, "class": top.Class, "x": top.X + 10, "y": top.Y, "side": "sideways"}
+
+	resp, b := alice.do("POST", tablePath(id, "update"), req)
+
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(b), "sideways") {
+		t.Fatalf("status %d %s", resp.StatusCode, b)
+	}
+	if it := srv.table(t, id).Items.Get(top.ID); it.Side != poker.Cover || it.X != top.X {
+		t.Fatalf("a rejected update changed the card: %+v", it)
+	}
+}
+
+func TestRecolorContention(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice, bob := srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	var free poker.Color
+	for _, c := range poker.PlayerColors() {
+		st := srv.table(t, id)
+		if st.Players[alice.userID].Color != c && st.Players[bob.userID].Color != c {
+			free = c
+			break
+		}
+	}
+
+	codes := make(chan int, 2)
+	var wg sync.WaitGroup
+	for _, c := range []*testClient{alice, bob} {
+		wg.Add(1)
+		go func(c *testClient) {
+			defer wg.Done()
+			resp, _ := c.do("POST", tablePath(id, "recolor"), map[string]string{"color": string(free)})
+			codes <- resp.StatusCode
+		}(c)
+	}
+	wg.Wait()
+	close(codes)
+
+	got := map[int]int{}
+	for code := range codes {
+		got[code]++
+	}
+	if got[http.StatusOK] != 1 || got[http.StatusConflict] != 1 {
+		t.Fatalf("both players asked for %s: %v", free, got)
+	}
+	players := srv.table(t, id).Players
+	if a, b := players[alice.userID].Color, players[bob.userID].Color; a == b || (a != free && b != free) {
+		t.Fatalf("alice is %s, bob is %s, one of them must be %s", a, b, free)
+	}
+}
+
+func TestBurnedCardsAreNeitherDealtNorSeen(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice, bob := srv.newClient(t), srv.newClient(t)
+	id := alice.createTable("")
+	bob.join(id)
+	pushes := bob.listen(id)
+
+	burned := &poker.Push{}
+	alice.mustCall("POST", tablePath(id, "burn"), map[string]any{}, burned)
+	card := burned.Items[0]
+	seen := waitPush(t, pushes, poker.UpdateItems)
+	for _, it := range []*poker.TableItem{card, seen.Items[0]} {
+		if !it.Burned || !isBlank(it) {
+			t.Fatalf("a burned card must be face down: %+v", it)
+		}
+	}
+
+	if resp, b := bob.do("POST", tablePath(id, "take_card"), map[string]int{"id": card.ID}); resp.StatusCode != http.StatusConflict ||
+		!strings.Contains(string(b), "burned") {
+		t.Fatalf("taking a burned card: status %d %s", resp.StatusCode, b)
+	}
+	dealt := &poker.Push{}
+	alice.mustCall("POST", tablePath(id, "deal"), map[string]any{"count": 25}, dealt) // all but one card left
+	if len(dealt.Items) != 50 {
+		t.Fatalf("%d cards dealt", len(dealt.Items))
+	}
+	for _, it := range dealt.Items {
+		if it.ID == card.ID {
+			t.Fatalf("the burned card is dealt: %+v", it)
+		}
+	}
+	for _, c := range []*testClient{alice, bob} {
+		for _, it := range c.state(id).Items {
+			if it.ID == card.ID && (!it.Burned || it.IsOwned() || !isBlank(it)) {
+				t.Fatalf("the burned card is revealed: %+v", it)
+			}
+		}
+	}
+}
+
+func TestPinDoesNotRevealCoveredCard(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	card := deckTop(alice.state(id))
+
+	pinned := &ItemUpdatedResponse{}
+	alice.mustCall("POST", tablePath(id, "pin"), map[string]int{"id": card.ID}, pinned)
+
+	if !pinned.Updated.Pinned || !isBlank(pinned.Updated) {
+		t.Fatalf("a pinned covered card must stay hidden: %+v", pinned.Updated)
+	}
+}
+
+func TestMoveDoesNotRevealCoveredCard(t *testing.T) {
+	srv := startTestServer(t, testConfig())
+	alice := srv.newClient(t)
+	id := alice.createTable("")
+	top := deckTop(alice.state(id))
+	req := map[string]any{"id": top.ID, "class": top.Class, "x": top.X + 100, "y": top.Y + 100, "side": top.Side}
+
+	moved := &ItemUpdatedResponse{}
+	alice.mustCall("POST", tablePath(id, "update"), req, moved)
+
+	if moved.Updated.X != top.X+100 || !isBlank(moved.Updated) {
+		t.Fatalf("a moved covered card must stay hidden: %+v", moved.Updated)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/poker"
+)
+
+// Metrics are served to operators at /debug/vars
+var (
+	metricTablesCreated  atomic.Int64
+	metricTablesRejected atomic.Int64
+	metricTablesReaped   atomic.Int64
+)
+
+func countTables(tables poker.TableMap, filter func(*poker.Table) bool) int {
+	n := 0
+	tables.Each(func(_ uuid.UUID, t *poker.Table) bool {
+		if filter == nil {
+			n++
+			return true
+		}
+		logError(t.ReadLock(context.Background(), func(t *poker.Table) error {
+			if filter(t) {
+				n++
+			}
+			return nil
+		}), "countTables")
+		return true
+	})
+	return n
+}
+
+// metrics serves the metrics as a JSON object. Unlike expvar it does not
+// expose the process details such as the command line carrying the admin token
+func (s *server) metrics(r *http.Request) (*httpx.Response, error) {
+	return httpx.JSON(http.StatusOK, m{
+		"tables_created":  metricTablesCreated.Load(),
+		"tables_rejected": metricTablesRejected.Load(),
+		"tables_reaped":   metricTablesReaped.Load(),
+		"ws_connections":  s.conns.count(),
+	}), nil
+}
@@ -2,13 +2,16 @@
 package httpx
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
 	"encoding/base32"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"strings"
 	"text/template"
@@ -34,9 +37,10 @@ const (
 // Intended to use in case of web sockets when the response is handled by external libs
 var ErrFinished = errors.New("request already finished")
 
-// RequestID returns a request id associated with a given context
+// RequestID returns a request id associated with a given context, empty if there is none
 func RequestID(ctx context.Context) string {
-	return fmt.Sprintf("%s", ctx.Value(requestIDKey))
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
 }
 
 // IsMobile detects whether request was made from a mobile device
@@ -61,11 +65,64 @@ type Response struct {
 
 	cookies []*http.Cookie
 
+	headers http.Header
+
 	contentType string
 
+	compressible bool
+
 	body []byte
 }
 
+// Compressible allows to gzip this response if the client accepts it
+func (r *Response) Compressible() *Response {
+	r.compressible = true
+	return r
+}
+
+// AcceptsGzip checks if the client accepts gzip encoded responses
+func AcceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(enc, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsHTML checks if the client is a browser navigating to a page
+func AcceptsHTML(r *http.Request) bool {
+	for _, typ := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(typ, ";", 2)[0]) == "text/html" {
+			return true
+		}
+	}
+	return false
+}
+
+// AcceptsJSON checks if the client prefers a JSON response
+func AcceptsJSON(r *http.Request) bool {
+	for _, typ := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.TrimSpace(strings.SplitN(typ, ";", 2)[0]) == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// Gzip compresses a given payload
+func Gzip(b []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if _, err := zw.Write(b); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func (r *Response) writeCookies(w http.ResponseWriter) {
 	for _, c := range r.cookies {
 		http.SetCookie(w, c)
@@ -78,6 +135,15 @@ func (r *Response) SetCookie(cookie *http.Cookie) *Response {
 	return r
 }
 
+// SetHeader sets a header on this response
+func (r *Response) SetHeader(name string, value string) *Response {
+	if r.headers == nil {
+		r.headers = http.Header{}
+	}
+	r.headers.Set(name, value)
+	return r
+}
+
 // Code returns HTTP code of this request
 func (r *Response) Code() int { return r.code }
 
@@ -128,7 +194,8 @@ func Redirect(url string) *Response {
 	return &Response{code: http.StatusFound, url: url}
 }
 
-// Error represents a http error that a handler can return to the client
+// Error represents a http error that a handler can return to the client.
+// It gets rendered as ErrorResponse JSON
 type Error struct {
 	Code    int
 	Message string
@@ -184,6 +251,34 @@ func writeResponse(
 		r.Method, r.URL, code, requestID, clientIP, int(time.Since(startedAt)/time.Millisecond))
 }
 
+func writeError(
+	r *http.Request,
+	w http.ResponseWriter,
+	code int,
+	msg string,
+	requestID string,
+	clientIP string,
+	startedAt time.Time) {
+
+	if errorPage != nil && AcceptsHTML(r) {
+		buf := &bytes.Buffer{}
+		data := &errorPageData{Code: code, Status: http.StatusText(code), Message: msg, RequestID: requestID}
+		err := errorPage.Execute(buf, data)
+		if err == nil {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			writeResponse(r, w, code, buf.Bytes(), requestID, clientIP, startedAt)
+			return
+		}
+		logger.Error.Printf("%s %s request_id=%s error page: %s", r.Method, r.URL, requestID, err)
+	}
+	b, err := json.Marshal(&ErrorResponse{Error: msg, RequestID: requestID})
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	writeResponse(r, w, code, b, requestID, clientIP, startedAt)
+}
+
 // H makes a http handler suitable for usage in go standard http lib out of httpx.RequestHandler
 func H(fn RequestHandler) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -199,10 +294,10 @@ func H(fn RequestHandler) func(http.ResponseWriter, *http.Request) {
 		logger.Info.Printf("%s %s request_id=%s client_ip=%s start", r.Method, r.URL, requestID, clientIP)
 		logger.Info.Printf("request_id=%s client_ip=%s browser: %s", requestID, clientIP, r.UserAgent())
 		if strings.Contains(r.UserAgent(), "Bot") {
-			writeResponse(r,
+			writeError(r,
 				w,
 				http.StatusForbidden,
-				[]byte("bots are not allowed"), requestID, clientIP, startedAt)
+				"bots are not allowed", requestID, clientIP, startedAt)
 			return
 		}
 		w.Header().Set(RequestHeaderName, requestID)
@@ -222,13 +317,16 @@ func H(fn RequestHandler) func(http.ResponseWriter, *http.Request) {
 				code = e.Code
 				msg = e.Message
 			default:
-				msg = fmt.Sprintf("%s: %s\n", http.StatusText(code), err)
+				msg = fmt.Sprintf("%s: %s", http.StatusText(code), err)
 			}
 			logger.Error.Printf("%s %s request_id=%s %s", r.Method, r.URL, requestID, err)
-			writeResponse(r, w, code, []byte(msg), requestID, clientIP, startedAt)
+			writeError(r, w, code, msg, requestID, clientIP, startedAt)
 			return
 		}
 		res.writeCookies(w)
+		for name, values := range res.headers {
+			w.Header()[name] = values
+		}
 		if res.code == http.StatusFound || res.code == http.StatusMovedPermanently {
 			logger.Info.Printf("%s %s request_id=%s client_ip=%s code=%d redirect_to=%s",
 				r.Method, r.URL, requestID, clientIP, res.code, res.url)
@@ -238,6 +336,117 @@ func H(fn RequestHandler) func(http.ResponseWriter, *http.Request) {
 		if res.contentType != "" {
 			w.Header().Set("Content-Type", res.contentType)
 		}
-		writeResponse(r, w, res.code, res.body, requestID, clientIP, startedAt)
+		if res.compressible {
+			w.Header().Add("Vary", "Accept-Encoding")
+		}
+		body := res.body // responses can be replayed, so keep them intact
+		if res.compressible && AcceptsGzip(r) {
+			if b, err := Gzip(body); err != nil {
+				logger.Error.Printf("%s %s request_id=%s gzip: %s", r.Method, r.URL, requestID, err)
+			} else {
+				w.Header().Set("Content-Encoding", "gzip")
+				body = b
+			}
+		}
+		writeResponse(r, w, res.code, body, requestID, clientIP, startedAt)
+	}
+}
+
+// errorPage renders errors for browsers, JSON is used if it is not set
+var errorPage *template.Template
+
+// errorPageData is what an error page template gets
+type errorPageData struct {
+	Code      int
+	Status    string
+	Message   string
+	RequestID string
+}
+
+// SetErrorPage makes errors render as a given HTML template for clients accepting text/html
+func SetErrorPage(t *template.Template) {
+	errorPage = t
+}
+
+// ErrorResponse is a JSON body of an error response
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	RequestID string `json:"request_id"`
+}
+
+// recoveryWriter tracks whether a response has already been started
+// so that a panic handler knows if it is still able to write an error back
+type recoveryWriter struct {
+	http.ResponseWriter
+
+	wroteHeader bool
+	hijacked    bool
+}
+
+func (w *recoveryWriter) WriteHeader(code int) {
+	w.wroteHeader = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *recoveryWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher so that streaming responses keep working behind this writer
+func (w *recoveryWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		w.wroteHeader = true
+		f.Flush()
 	}
 }
+
+// Hijack implements http.Hijacker so that web sockets keep working behind this writer
+func (w *recoveryWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("http.Hijacker is not supported")
+	}
+	w.hijacked = true
+	return hj.Hijack()
+}
+
+// Recover is a middleware that recovers handlers from panics.
+// It logs a panic and returns 500 with a JSON error if the response has not been started yet.
+// Hijacked connections(web sockets) are left alone as no http response is possible there.
+func Recover(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := &recoveryWriter{ResponseWriter: w}
+		defer func() {
+			rec := recover()
+			if rec == nil {
+				return
+			}
+			if rec == http.ErrAbortHandler {
+				panic(rec) // let net/http abort the response silently
+			}
+			requestID := w.Header().Get(RequestHeaderName)
+			if requestID == "" {
+				requestID = r.Header.Get(RequestHeaderName)
+			}
+			logger.Error.Printf("%s %s request_id=%s panic: %v", r.Method, r.URL, requestID, rec)
+			if rw.hijacked || rw.wroteHeader {
+				return
+			}
+			b, err := json.Marshal(&ErrorResponse{
+				Error:     http.StatusText(http.StatusInternalServerError),
+				RequestID: requestID,
+			})
+			if err != nil {
+				logger.Error.Printf("request_id=%s json.Marshal: %s", requestID, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusInternalServerError)
+			if _, err := w.Write(b); err != nil {
+				logger.Error.Printf("request_id=%s response write failed: %s", requestID, err)
+			}
+		}()
+		next.ServeHTTP(rw, r)
+	})
+}
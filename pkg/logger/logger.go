@@ -4,8 +4,48 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
+	"sync/atomic"
 )
 
+// Level is a minimal severity of messages that get logged
+type Level int32
+
+// Available log levels
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	ErrorLevel
+)
+
+var levelNames = []string{"debug", "info", "error"}
+
+func (l Level) String() string {
+	if l < DebugLevel || l > ErrorLevel {
+		return fmt.Sprintf("Level(%d)", int32(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level by its name
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(name, strings.TrimSpace(s)) {
+			return Level(i), nil
+		}
+	}
+	return DebugLevel, fmt.Errorf("unknown log level: %s", s)
+}
+
+// level is the current log level, all messages are logged by default
+var level int32 = int32(DebugLevel)
+
+// SetLevel sets the current log level, it is safe to call at runtime
+func SetLevel(l Level) { atomic.StoreInt32(&level, int32(l)) }
+
+// GetLevel returns the current log level
+func GetLevel() Level { return Level(atomic.LoadInt32(&level)) }
+
 const defaultLogFlags = log.LstdFlags | log.Llongfile | log.Lmsgprefix
 
 var (
@@ -24,9 +64,19 @@ var (
 func init() {
 	log.SetFlags(defaultLogFlags)
 
-	Debug = newLogger("DEBUG", 2)
-	Error = newLogger("ERROR", 2)
-	Info = newLogger("INFO", 2)
+	Debug = newLogger("DEBUG", DebugLevel, 2)
+	Error = newLogger("ERROR", ErrorLevel, 2)
+	Info = newLogger("INFO", InfoLevel, 2)
+
+	// LOG_LEVEL env variable sets the initial log level
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		l, err := ParseLevel(v)
+		if err != nil {
+			Error.Printf("LOG_LEVEL: %s", err)
+			return
+		}
+		SetLevel(l)
+	}
 }
 
 // Null returns null logger implementation
@@ -46,23 +96,33 @@ func (l *nullLogger) Printf(format string, v ...interface{}) {}
 
 type loggerImpl struct {
 	depth int
+	level Level
 	log   *log.Logger
 }
 
-func newLogger(prefix string, depth int) *loggerImpl {
+func newLogger(prefix string, level Level, depth int) *loggerImpl {
 	return &loggerImpl{
 		depth: depth,
+		level: level,
 		log:   log.New(os.Stderr, prefix+" ", inferLogFlags()),
 	}
 }
 
+func (l *loggerImpl) enabled() bool { return l.level >= GetLevel() }
+
 func (l *loggerImpl) SetDepth(depth int) { l.depth = depth }
 
 func (l *loggerImpl) Println(v ...interface{}) {
+	if !l.enabled() {
+		return
+	}
 	l.log.Output(l.depth, fmt.Sprintln(v...))
 }
 
 func (l *loggerImpl) Printf(format string, v ...interface{}) {
+	if !l.enabled() {
+		return
+	}
 	for _, it := range v {
 		if err, ok := it.(error); ok {
 			format = fmt.Sprintf("err_type=%T ", err) + format
@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"testing"
+)
+
+func TestSetLevelToggles(t *testing.T) {
+	prev := GetLevel()
+	t.Cleanup(func() { SetLevel(prev) })
+	var buf bytes.Buffer
+	debug := &loggerImpl{depth: 2, level: DebugLevel, log: log.New(&buf, "", 0)}
+	info := &loggerImpl{depth: 2, level: InfoLevel, log: log.New(&buf, "", 0)}
+
+	SetLevel(InfoLevel)
+	debug.Printf("hidden")
+	info.Printf("shown")
+	if buf.String() != "shown\n" {
+		t.Fatalf("info level: %q", buf.String())
+	}
+
+	buf.Reset()
+	SetLevel(DebugLevel)
+	debug.Println("debug")
+	if buf.String() != "debug\n" {
+		t.Fatalf("debug level: %q", buf.String())
+	}
+
+	buf.Reset()
+	SetLevel(ErrorLevel)
+	debug.Printf("hidden")
+	info.Println("hidden")
+	if buf.Len() != 0 {
+		t.Fatalf("error level: %q", buf.String())
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	var tests = []struct {
+		given    string
+		expected Level
+	}{
+		{"debug", DebugLevel},
+		{" INFO ", InfoLevel},
+		{"Error", ErrorLevel},
+	}
+	for _, tt := range tests {
+		actual, err := ParseLevel(tt.given)
+		if err != nil || actual != tt.expected {
+			t.Fatalf("%q: expected %s, actual %s %v", tt.given, tt.expected, actual, err)
+		}
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.Fatal("an unknown level is parsed")
+	}
+}
@@ -0,0 +1,59 @@
+package poker
+
+// DeckAudit counts cards on a table wherever they are: in the deck, in hands or on the board.
+// It only aggregates, so it tells nothing about who holds which hidden card
+type DeckAudit struct {
+	Total int `json:"total"`
+
+	// Conjured is a number of made up cards, they are not counted anywhere else
+	Conjured int `json:"conjured"`
+
+	// Burned is a number of cards in the burn pile, they are counted in the total too
+	Burned int `json:"burned"`
+
+	Ranks map[string]int `json:"ranks"`
+	Suits map[Suit]int   `json:"suits"`
+
+	// Missing are cards of a full deck absent from the table
+	Missing []string `json:"missing"`
+
+	// Duplicated are cards present more than once
+	Duplicated []string `json:"duplicated"`
+
+	// OK is set if the table has exactly one full deck
+	OK bool `json:"ok"`
+}
+
+// AuditDeck counts all the cards of this table
+func (t *Table) AuditDeck() *DeckAudit {
+	res := &DeckAudit{Ranks: map[string]int{}, Suits: map[Suit]int{}, Missing: []string{}, Duplicated: []string{}}
+	seen := map[Card]int{}
+	for _, it := range t.Items {
+		if !it.Is(CardClass) {
+			continue
+		}
+		if it.Conjured {
+			res.Conjured++
+			continue
+		}
+		if it.Burned {
+			res.Burned++
+		}
+		res.Total++
+		res.Ranks[it.Rank]++
+		res.Suits[it.Suit]++
+		seen[Card{Rank: it.Rank, Suit: it.Suit}]++
+	}
+	for _, suit := range []Suit{Spades, Hearts, Diamonds, Clubs} {
+		for _, rank := range Ranks {
+			switch n := seen[Card{Rank: rank, Suit: suit}]; {
+			case n == 0:
+				res.Missing = append(res.Missing, rank+string(suit))
+			case n > 1:
+				res.Duplicated = append(res.Duplicated, rank+string(suit))
+			}
+		}
+	}
+	res.OK = len(res.Missing) == 0 && len(res.Duplicated) == 0 && res.Total == len(Ranks)*4
+	return res
+}
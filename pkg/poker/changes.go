@@ -0,0 +1,69 @@
+package poker
+
+// maxChanges is a number of recent changes a table remembers for clients catching up
+const maxChanges = 64
+
+// tableChange is a single change of a table, recorded from the pushes sent to players
+type tableChange struct {
+	version int
+
+	// itemIDs are ids of the changed items
+	itemIDs []int
+
+	// full means the change is not described by items, e.g. a refresh
+	full bool
+}
+
+// recordChange bumps the version of this table and remembers items changed by a given push
+func (t *Table) recordChange(p *Push) {
+	t.Version++
+	ch := tableChange{version: t.Version, full: p.Type == Refresh}
+	for _, it := range p.Items {
+		ch.itemIDs = append(ch.itemIDs, it.ID)
+	}
+	t.changes = append(t.changes, ch)
+	if len(t.changes) > maxChanges {
+		t.changes = t.changes[len(t.changes)-maxChanges:]
+	}
+}
+
+// ChangedSince returns ids of the items changed after a given version.
+// It returns false if the changes can not be told from recent history, then a full state is needed
+func (t *Table) ChangedSince(version int) ([]int, bool) {
+	if version > t.Version || version < 0 {
+		return nil, false
+	}
+	if version == t.Version {
+		return []int{}, true
+	}
+	if len(t.changes) == 0 || t.changes[0].version > version+1 {
+		return nil, false // too old: some changes have been forgotten
+	}
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, ch := range t.changes {
+		if ch.version <= version {
+			continue
+		}
+		if ch.full {
+			return nil, false
+		}
+		for _, id := range ch.itemIDs {
+			if !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids, true
+}
+
+// keepItems replaces the items of this table with given ones. Changes only tell which items
+// have changed, so if any item is gone a full change is recorded: clients catching up
+// get the full state instead of keeping the removed items
+func (t *Table) keepItems(items TableItemList) {
+	if len(items) < len(t.Items) {
+		t.recordChange(NewPushRefresh())
+	}
+	t.Items = items
+}
@@ -0,0 +1,29 @@
+package poker
+
+import "time"
+
+// Clock tells the current time. Time dependent logic asks it instead of calling time.Now
+// so that it can be driven deterministically
+type Clock interface {
+	Now() time.Time
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time { return time.Now() }
+
+// WallClock is the real time clock
+var WallClock Clock = wallClock{}
+
+// SetClock sets the clock of this table, nil restores the wall clock
+func (t *Table) SetClock(c Clock) {
+	t.clock = c
+}
+
+// Now returns the current time by the clock of this table
+func (t *Table) Now() time.Time {
+	if t.clock == nil {
+		return WallClock.Now()
+	}
+	return t.clock.Now()
+}
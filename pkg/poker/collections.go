@@ -1,6 +1,7 @@
 package poker
 
 import (
+	"context"
 	"encoding/json"
 	"sync"
 
@@ -67,7 +68,15 @@ func (m *baseUUIDUserPtrMap) MarshalJSON() ([]byte, error) {
 }
 
 func (m *baseUUIDUserPtrMap) UnmarshalJSON(b []byte) error {
-	return json.Unmarshal(b, &m._map)
+	if err := json.Unmarshal(b, &m._map); err != nil {
+		return err
+	}
+	for _, u := range m._map {
+		if u.LastSeenAt == nil { // saved before LastSeenAt was added
+			u.LastSeenAt = NewSeenTime(u.CreatedAt)
+		}
+	}
+	return nil
 }
 
 func (m *baseUUIDUserPtrMap) Get(key uuid.UUID) (v *User, found bool) {
@@ -245,8 +254,19 @@ func (m *baseTableMap) Update(src map[uuid.UUID]*Table) TableMap {
 	return m
 }
 
+// MarshalJSON marshals each table under its read lock: tables keep getting updated while saved
 func (m *baseTableMap) MarshalJSON() ([]byte, error) {
-	return json.Marshal(m._map)
+	tables := make(map[uuid.UUID]json.RawMessage, len(m._map))
+	for id, t := range m._map {
+		if err := t.ReadLock(context.Background(), func(t *Table) error {
+			b, err := json.Marshal(t)
+			tables[id] = b
+			return err
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(tables)
 }
 
 func (m *baseTableMap) UnmarshalJSON(b []byte) error {
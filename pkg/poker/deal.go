@@ -0,0 +1,256 @@
+package poker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+// DealPattern defines the order in which cards are dealt to players
+type DealPattern string
+
+// Available deal patterns
+const (
+	// OneByOne deals one card to each player in turn, then the next one, as real dealers do
+	OneByOne DealPattern = "one_by_one"
+	// AllAtOnce gives each player their full hand before moving on to the next player
+	AllAtOnce DealPattern = "all_at_once"
+)
+
+// IsValid checks if this pattern is known
+func (p DealPattern) IsValid() bool { return p == OneByOne || p == AllAtOnce }
+
+// deckOrigin returns a position of the deck on this table
+func (t *Table) deckOrigin() (int, int) {
+	if t.DeckX == 0 && t.DeckY == 0 {
+		return deckX, deckY
+	}
+	return t.DeckX, t.DeckY
+}
+
+// isInDeck checks if a given item lies in the deck pile
+func (t *Table) isInDeck(it *TableItem) bool {
+	x, y := t.deckOrigin()
+	return it.Is(CardClass) && !it.IsOwned() && it.Side == Cover && !it.Pinned &&
+		it.Y == y && it.X >= x && it.X < x+deckSize
+}
+
+// MoveDeck moves the deck origin and all cards in the deck pile by a given delta
+// keeping their stacking offsets. Returns moved cards
+func (t *Table) MoveDeck(dx int, dy int) (TableItemList, error) {
+	x, y := t.deckOrigin()
+	x, y = x+dx, y+dy
+	size := t.Size()
+	if x < 0 || y < 0 || x+deckSize+cardWidth > size.Width || y+cardHeight > size.Height {
+		return nil, httpx.NewError(http.StatusBadRequest, "deck can't be moved outside the table")
+	}
+	pile := t.DeckPile()
+	for _, it := range pile {
+		it.X += dx
+		it.Y += dy
+	}
+	t.DeckX, t.DeckY = x, y
+	return pile, nil
+}
+
+// DeckPile returns cards that lie in the deck pile ordered from the bottom to the top one
+func (t *Table) DeckPile() TableItemList {
+	pile := TableItemList{}
+	for _, it := range t.Items {
+		if t.isInDeck(it) {
+			pile = append(pile, it)
+		}
+	}
+	sort.SliceStable(pile, func(i, j int) bool { return pile[i].X < pile[j].X })
+	return pile
+}
+
+// SetDeckOrder rearranges the deck pile in a given order of card ids starting from the top card,
+// i.e. the one dealt first. The ids must be a permutation of the cards in the pile
+func (t *Table) SetDeckOrder(ids []int) error {
+	pile := t.DeckPile()
+	if len(ids) != len(pile) {
+		return httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("expected %d card ids, got %d", len(pile), len(ids)))
+	}
+	byID := map[int]*TableItem{}
+	for _, it := range pile {
+		byID[it.ID] = it
+	}
+	cards := make([]*TableItem, len(ids))
+	for i, id := range ids {
+		it := byID[id]
+		if it == nil {
+			return httpx.NewError(http.StatusBadRequest,
+				fmt.Sprintf("card %d is not in the deck or listed twice", id))
+		}
+		delete(byID, id)
+		cards[len(cards)-1-i] = it
+	}
+	// the pile is ordered from the bottom, cards take its places keeping the offsets
+	xs := make([]int, len(pile))
+	for i, it := range pile {
+		xs[i] = it.X
+	}
+	for i, it := range cards {
+		it.X = xs[i]
+	}
+	return nil
+}
+
+// DeckTop returns the top card of the deck pile or nil if the deck is empty
+func (t *Table) DeckTop() *TableItem {
+	pile := t.DeckPile()
+	if len(pile) == 0 {
+		return nil
+	}
+	return pile[len(pile)-1]
+}
+
+// DeckItem returns a single item representing the whole deck pile
+func (t *Table) DeckItem() *TableItem {
+	x, y := t.deckOrigin()
+	it := NewTableItem(DeckItemID, x, y, t.Now())
+	it.Class = DeckClass
+	it.Side = Cover
+	it.Count = len(t.DeckPile())
+	return it
+}
+
+// CompactItems replaces cards lying in the deck pile with a single deck item if
+// the deck is stacked on this table. Items must be copies
+func (t *Table) CompactItems(items []*TableItem) []*TableItem {
+	if !t.StackedDeck {
+		return items
+	}
+	res := make([]*TableItem, 0, len(items)+1)
+	for _, it := range items {
+		if !t.isInDeck(it) {
+			res = append(res, it)
+		}
+	}
+	return append(res, t.DeckItem())
+}
+
+// ownedCount returns a number of cards a given player owns
+func (t *Table) ownedCount(p *Player) int {
+	n := 0
+	for _, it := range t.Items {
+		if it.Is(CardClass) && it.IsOwnedBy(p.ID) {
+			n++
+		}
+	}
+	return n
+}
+
+// countCards refreshes the numbers of cards the players hold
+func (t *Table) countCards() {
+	counts := map[string]int{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && it.IsOwned() {
+			counts[it.OwnerID]++
+		}
+	}
+	for _, p := range t.Players {
+		p.Cards = counts[p.ID.String()]
+	}
+}
+
+// CheckHand returns an error if a player can not get n more cards because of the hand limit
+func (t *Table) CheckHand(p *Player, n int) error {
+	if t.MaxHand > 0 && t.ownedCount(p)+n > t.MaxHand {
+		return httpx.NewError(http.StatusConflict,
+			fmt.Sprintf("%s can not hold more than %d cards", p.Name, t.MaxHand))
+	}
+	return nil
+}
+
+// Deal deals count cards from the top of the deck to each player following a given pattern.
+// Returns dealt cards in the order they have been dealt
+func (t *Table) Deal(pattern DealPattern, count int) (TableItemList, error) {
+	if !pattern.IsValid() {
+		return nil, httpx.NewError(http.StatusBadRequest, "unknown deal pattern: "+string(pattern))
+	}
+	if count <= 0 {
+		return nil, httpx.NewError(http.StatusBadRequest, "count must be positive")
+	}
+	players := t.SortedPlayers()
+	pile := t.DeckPile()
+	if count*len(players) > len(pile) {
+		return nil, httpx.NewError(http.StatusConflict,
+			fmt.Sprintf("not enough cards in the deck: %d", len(pile)))
+	}
+	held := map[*Player]int{}
+	for _, p := range players {
+		if err := t.CheckHand(p, count); err != nil {
+			return nil, err
+		}
+		held[p] = t.ownedCount(p)
+	}
+	dealt := TableItemList{}
+	dealTo := func(p *Player) {
+		card := pile[len(pile)-1]
+		pile = pile[:len(pile)-1]
+		card.X, card.Y = dealtCardPosition(p.Index, held[p])
+		card.Take(p.User)
+		held[p]++
+		dealt = append(dealt, card)
+	}
+	switch pattern {
+	case OneByOne:
+		for i := 0; i < count; i++ {
+			for _, p := range players {
+				dealTo(p)
+			}
+		}
+	case AllAtOnce:
+		for _, p := range players {
+			for i := 0; i < count; i++ {
+				dealTo(p)
+			}
+		}
+	}
+	return dealt, nil
+}
+
+// ConjureCard puts a made up card of a given rank and suit into a player's hand.
+// The card is flagged as conjured and disappears on the next shuffle
+func (t *Table) ConjureCard(p *Player, rank string, suit Suit) (*TableItem, error) {
+	if rankValue(rank) == 0 {
+		return nil, httpx.NewError(http.StatusBadRequest, "bad rank: "+rank)
+	}
+	if !suit.IsValid() {
+		return nil, httpx.NewError(http.StatusBadRequest, "bad suit: "+string(suit))
+	}
+	if err := t.CheckHand(p, 1); err != nil {
+		return nil, err
+	}
+	x, y := dealtCardPosition(p.Index, t.ownedCount(p))
+	it := NewTableItem(t.nextID(), x, y, t.Now()).AsCard(&Card{Rank: rank, Suit: suit, Side: Cover})
+	it.OwnerID = p.ID.String()
+	it.Conjured = true
+	t.Items = append(t.Items, it)
+	t.BringToTop(it)
+	return it, nil
+}
+
+// PassCard transfers a card owned by one player into another player's hand face down
+func (t *Table) PassCard(it *TableItem, from *Player, to *Player) error {
+	if !it.Is(CardClass) {
+		return httpx.NewError(http.StatusBadRequest, "only cards can be passed")
+	}
+	if !it.IsOwnedBy(from.ID) {
+		return httpx.NewError(http.StatusForbidden, "you do not own this card")
+	}
+	if err := t.CheckHand(to, 1); err != nil {
+		return err
+	}
+	it.X, it.Y = dealtCardPosition(to.Index, t.ownedCount(to))
+	it.OwnerID = to.ID.String()
+	it.ShownTo = nil
+	it.Side = Cover
+	t.BringToTop(it)
+	return nil
+}
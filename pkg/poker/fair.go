@@ -0,0 +1,48 @@
+package poker
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	mrand "math/rand"
+	"sort"
+)
+
+// fairSeedSize is a number of random bytes in a provably fair shuffle seed
+const fairSeedSize = 32
+
+// FairCommitment returns a commitment to a given shuffle seed: hex encoded sha256 of the seed string
+func FairCommitment(seed string) string {
+	sum := sha256.Sum256([]byte(seed))
+	return hex.EncodeToString(sum[:])
+}
+
+// FairShuffle reproduces a provably fair shuffle of given cards: cards are ordered
+// by their ids first and then shuffled by math/rand seeded with the first 8 bytes of the hex decoded seed
+func FairShuffle(cards []*TableItem, seed string) error {
+	b, err := hex.DecodeString(seed)
+	if err != nil {
+		return err
+	}
+	if len(b) < 8 {
+		return fmt.Errorf("seed is too short: %d bytes", len(b))
+	}
+	sort.Slice(cards, func(i, j int) bool { return cards[i].ID < cards[j].ID })
+	rnd := mrand.New(mrand.NewSource(int64(binary.BigEndian.Uint64(b[:8]))))
+	shuffle(cards, rnd.Intn)
+	return nil
+}
+
+// commitShuffle generates a new shuffle seed revealing the previous one
+func (t *Table) commitShuffle() error {
+	b := make([]byte, fairSeedSize)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	t.RevealedSeed = t.ShuffleSeed
+	t.ShuffleSeed = hex.EncodeToString(b)
+	t.ShuffleCommitment = FairCommitment(t.ShuffleSeed)
+	return nil
+}
@@ -0,0 +1,74 @@
+package poker
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// fairOrder reproduces the deck order of a given seed like a player would: from any order of the cards
+func fairOrder(t *testing.T, table *Table, seed string) []int {
+	cards := TableItemList{}
+	for _, it := range table.Items[0:deckSize] {
+		cards = append(cards, &TableItem{ID: it.ID})
+	}
+	if err := FairShuffle(cards, seed); err != nil {
+		t.Fatal(err)
+	}
+	ids := []int{}
+	for _, it := range cards {
+		ids = append(ids, it.ID)
+	}
+	return ids
+}
+
+func TestFairShuffleIsReproducedFromRevealedSeed(t *testing.T) {
+	table := NewTable(uuid.New(), 10)
+	table.ProvablyFair = true
+	table.StartGame()
+	commitment := table.ShuffleCommitment
+	order := deckOrder(table)
+
+	table.NewHand(nil)
+
+	if table.RevealedSeed == "" || table.RevealedSeed == table.ShuffleSeed {
+		t.Fatalf("the seed of the previous shuffle is not revealed: %q", table.RevealedSeed)
+	}
+	if FairCommitment(table.RevealedSeed) != commitment {
+		t.Fatal("the revealed seed does not match the commitment")
+	}
+	if actual := fairOrder(t, table, table.RevealedSeed); !reflect.DeepEqual(order, actual) {
+		t.Fatalf("the shuffle is not reproduced:\nexpected %v\nactual   %v", order, actual)
+	}
+}
+
+func TestFairShuffleRejectsBadSeeds(t *testing.T) {
+	for _, seed := range []string{"", "zz", "0011"} {
+		if err := FairShuffle(TableItemList{{ID: 1}, {ID: 2}}, seed); err == nil {
+			t.Fatalf("seed %q is accepted", seed)
+		}
+	}
+}
+
+func TestFairShuffleIsNotUndone(t *testing.T) {
+	alice := newTestUser("alice")
+	table := NewTable(uuid.New(), 10)
+	table.ProvablyFair = true
+	table.StartGame()
+	table.Join(alice)
+	before := deckOrder(table)
+
+	table.ShuffleBy(alice, epoch)
+	revealed := table.RevealedSeed // everyone sees it in the state
+	if !reflect.DeepEqual(before, fairOrder(t, table, revealed)) {
+		t.Fatal("the revealed seed must reproduce the order before the shuffle")
+	}
+
+	if err := table.UndoShuffle(alice); err == nil {
+		t.Fatal("a provably fair shuffle must not be undone")
+	}
+	if reflect.DeepEqual(deckOrder(table), fairOrder(t, table, revealed)) {
+		t.Fatal("the deck in play is rebuilt from the revealed seed")
+	}
+}
@@ -0,0 +1,228 @@
+package poker
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+// HandRank is a category of a poker hand
+type HandRank int
+
+// Hand ranks from the weakest to the strongest
+const (
+	HighCard HandRank = iota
+	OnePair
+	TwoPair
+	ThreeOfAKind
+	Straight
+	Flush
+	FullHouse
+	FourOfAKind
+	StraightFlush
+)
+
+var handRankNames = []string{
+	"high card", "one pair", "two pair", "three of a kind", "straight",
+	"flush", "full house", "four of a kind", "straight flush",
+}
+
+func (r HandRank) String() string {
+	if r < 0 || int(r) >= len(handRankNames) {
+		return fmt.Sprintf("HandRank(%d)", int(r))
+	}
+	return handRankNames[r]
+}
+
+// handSize is a number of cards a poker hand consists of
+const handSize = 5
+
+// Hand is the best five card poker hand out of some cards
+type Hand struct {
+	Rank HandRank `json:"rank"`
+
+	// Cards are the five cards making this hand
+	Cards []Card `json:"cards"`
+
+	// values break ties between hands of the same rank, most significant first
+	values []int
+}
+
+// Describe returns a human readable description of this hand
+func (h *Hand) Describe() string {
+	return h.Rank.String()
+}
+
+// Compare compares this hand with another one: it returns a positive number
+// if this hand is stronger, a negative one if it is weaker and zero on a tie
+func (h *Hand) Compare(o *Hand) int {
+	if h.Rank != o.Rank {
+		return int(h.Rank) - int(o.Rank)
+	}
+	for i := range h.values {
+		if h.values[i] != o.values[i] {
+			return h.values[i] - o.values[i]
+		}
+	}
+	return 0
+}
+
+// rankValue returns a value of a card rank: 2 is the lowest, ace is the highest
+func rankValue(rank string) int {
+	for i, r := range Ranks {
+		if r == rank {
+			return i + 2
+		}
+	}
+	return 0
+}
+
+// EvaluateHand finds the best five card hand out of 5 to 7 given cards
+func EvaluateHand(cards []Card) (*Hand, error) {
+	if len(cards) < handSize || len(cards) > 7 {
+		return nil, httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("a hand is evaluated out of 5 to 7 cards, got %d", len(cards)))
+	}
+	for _, c := range cards {
+		if rankValue(c.Rank) == 0 {
+			return nil, httpx.NewError(http.StatusBadRequest, "unknown card rank: "+c.Rank)
+		}
+	}
+	var best *Hand
+	combo := make([]Card, handSize)
+	var pick func(start int, n int)
+	pick = func(start int, n int) {
+		if n == handSize {
+			h := evaluateFive(combo)
+			if best == nil || h.Compare(best) > 0 {
+				best = h
+			}
+			return
+		}
+		for i := start; i < len(cards); i++ {
+			combo[n] = cards[i]
+			pick(i+1, n+1)
+		}
+	}
+	pick(0, 0)
+	return best, nil
+}
+
+// evaluateFive evaluates exactly five cards
+func evaluateFive(cards []Card) *Hand {
+	h := &Hand{Cards: append([]Card{}, cards...)}
+	sort.Slice(h.Cards, func(i, j int) bool { return rankValue(h.Cards[i].Rank) > rankValue(h.Cards[j].Rank) })
+
+	counts := map[int]int{}
+	flush := true
+	for _, c := range h.Cards {
+		counts[rankValue(c.Rank)]++
+		flush = flush && c.Suit == h.Cards[0].Suit
+	}
+	// group values by their counts: bigger groups first, then higher values
+	groups := make([]int, 0, len(counts))
+	for v := range counts {
+		groups = append(groups, v)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if counts[groups[i]] != counts[groups[j]] {
+			return counts[groups[i]] > counts[groups[j]]
+		}
+		return groups[i] > groups[j]
+	})
+	h.values = groups
+
+	straightHigh := 0
+	if len(groups) == handSize {
+		switch {
+		case groups[0]-groups[4] == 4:
+			straightHigh = groups[0]
+		case groups[0] == rankValue("A") && groups[1] == 5:
+			straightHigh = 5 // the wheel: A-2-3-4-5
+		}
+	}
+	switch {
+	case straightHigh > 0 && flush:
+		h.Rank, h.values = StraightFlush, []int{straightHigh}
+	case counts[groups[0]] == 4:
+		h.Rank = FourOfAKind
+	case counts[groups[0]] == 3 && counts[groups[1]] == 2:
+		h.Rank = FullHouse
+	case flush:
+		h.Rank = Flush
+	case straightHigh > 0:
+		h.Rank, h.values = Straight, []int{straightHigh}
+	case counts[groups[0]] == 3:
+		h.Rank = ThreeOfAKind
+	case counts[groups[0]] == 2 && counts[groups[1]] == 2:
+		h.Rank = TwoPair
+	case counts[groups[0]] == 2:
+		h.Rank = OnePair
+	default:
+		h.Rank = HighCard
+	}
+	return h
+}
+
+// PlayerHand is the best hand of a player made of the cards the player has shown and community cards
+type PlayerHand struct {
+	PlayerID string `json:"player_id"`
+	Name     string `json:"name"`
+	Hand     *Hand  `json:"hand"`
+
+	Description string `json:"description"`
+}
+
+// Result is an outcome of a showdown
+type Result struct {
+	// Winners are ids of the players with the best hand, more than one on a split
+	Winners []string `json:"winners"`
+
+	Hands []*PlayerHand `json:"hands"`
+}
+
+// Result ranks hands of the players who have shown their cards. Only face up cards
+// nobody owns are considered: the ones shown by players and community cards
+// that were never owned. Hidden hands are never looked at
+func (t *Table) Result() *Result {
+	community := []Card{}
+	shown := map[string][]Card{}
+	for _, it := range t.Items {
+		if !it.Is(CardClass) || it.IsOwned() || it.Mucked || it.Side != Face {
+			continue
+		}
+		if it.PrevOwnerID == "" {
+			community = append(community, it.Card)
+			continue
+		}
+		shown[it.PrevOwnerID] = append(shown[it.PrevOwnerID], it.Card)
+	}
+	res := &Result{Winners: []string{}, Hands: []*PlayerHand{}}
+	var best *Hand
+	for _, p := range t.SortedPlayers() {
+		cards := shown[p.ID.String()]
+		if len(cards) == 0 || p.Folded {
+			continue
+		}
+		hand, err := EvaluateHand(append(append([]Card{}, cards...), community...))
+		if err != nil {
+			continue // not enough or too many cards to make a hand
+		}
+		res.Hands = append(res.Hands, &PlayerHand{
+			PlayerID:    p.ID.String(),
+			Name:        p.ShownName(),
+			Hand:        hand,
+			Description: hand.Describe(),
+		})
+		switch {
+		case best == nil || hand.Compare(best) > 0:
+			best = hand
+			res.Winners = []string{p.ID.String()}
+		case hand.Compare(best) == 0:
+			res.Winners = append(res.Winners, p.ID.String())
+		}
+	}
+	return res
+}
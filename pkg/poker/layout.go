@@ -0,0 +1,182 @@
+package poker
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+// Dimensions of the objects on the table. They have to be kept in sync with poker.css
+const (
+	tableWidth  = 1280
+	tableHeight = 720
+
+	// limits of custom table dimensions
+	minTableWidth  = 640
+	maxTableWidth  = 2560
+	minTableHeight = 360
+	maxTableHeight = 1440
+
+	cardWidth  = 110
+	cardHeight = 146
+
+	chipWidth = 70
+
+	dealerWidth = 90
+
+	// player slot: chips lying within it belong to the player
+	slotWidth  = 400
+	slotHeight = 180
+
+	// deck origin: shuffled cards are stacked from here with 1px offset each
+	deckX = 150
+	deckY = 20
+
+	// burnGap is a distance between the deck pile and the burn pile
+	burnGap = 20
+
+	// muck origin: folded cards are put here
+	muckX = 1000
+	muckY = 280
+)
+
+// seats are top left corners of the players slots
+var seats = [][]int{
+	{0, 535},
+	{880, 0},
+	{880, 535},
+}
+
+// seatZone returns the slot of a given seat
+func seatZone(seat int) *Rect {
+	s := seats[seat%len(seats)]
+	return &Rect{X: s[0], Y: s[1], Width: slotWidth, Height: slotHeight}
+}
+
+// dealtCardPosition returns a position of n-th card dealt to a player at a given seat.
+// Cards are placed right outside the seat not to cover player's chips
+func dealtCardPosition(seat int, n int) (int, int) {
+	s := seats[seat%len(seats)]
+	x := s[0] + 20 + n*30
+	if s[1] == 0 {
+		return x, 190
+	}
+	return x, s[1] - cardHeight - 10
+}
+
+// Size represents dimensions of an object
+type Size struct {
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Rect represents a rectangular zone on the table
+type Rect struct {
+	X      int `json:"x"`
+	Y      int `json:"y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+}
+
+// Layout describes sizes of the table and the objects on it so that
+// all clients agree on the geometry regardless of their screens
+type Layout struct {
+	Table  Size `json:"table"`
+	Card   Size `json:"card"`
+	Chip   Size `json:"chip"`
+	Dealer Size `json:"dealer"`
+
+	// Community is a zone for community cards, only for games that have them
+	Community *Rect `json:"community,omitempty"`
+
+	// Muck is a zone for folded and returned cards
+	Muck *Rect `json:"muck"`
+
+	// Burn is a zone for burned cards, it lies next to the deck
+	Burn *Rect `json:"burn"`
+}
+
+// Contains checks if a given point lies within this zone
+func (r *Rect) Contains(x int, y int) bool {
+	return x >= r.X && x <= r.X+r.Width && y >= r.Y && y <= r.Y+r.Height
+}
+
+// muckZone is where folded and returned cards are piled up with 1px offset each
+var muckZone = &Rect{X: muckX, Y: muckY, Width: cardWidth + deckSize, Height: cardHeight}
+
+// burnZone is where burned cards are piled up with 1px offset each, right of the deck
+func (t *Table) burnZone() *Rect {
+	x, y := t.deckOrigin()
+	return &Rect{X: x + deckSize + cardWidth + burnGap, Y: y, Width: cardWidth + deckSize, Height: cardHeight}
+}
+
+// Layout returns the layout of this table
+func (t *Table) Layout() *Layout {
+	return &Layout{
+		Table:  t.Size(),
+		Card:   Size{Width: cardWidth, Height: cardHeight},
+		Chip:   Size{Width: chipWidth, Height: chipWidth},
+		Dealer: Size{Width: dealerWidth, Height: dealerWidth},
+
+		Community: t.template().community,
+		Muck:      muckZone,
+		Burn:      t.burnZone(),
+	}
+}
+
+// Size returns dimensions of this table
+func (t *Table) Size() Size {
+	size := Size{Width: t.Width, Height: t.Height}
+	if size.Width == 0 {
+		size.Width = tableWidth
+	}
+	if size.Height == 0 {
+		size.Height = tableHeight
+	}
+	return size
+}
+
+// SetSize sets dimensions of this table, zeroes keep the default ones
+func (t *Table) SetSize(width int, height int) error {
+	if width != 0 && (width < minTableWidth || width > maxTableWidth) {
+		return httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("width must be between %d and %d", minTableWidth, maxTableWidth))
+	}
+	if height != 0 && (height < minTableHeight || height > maxTableHeight) {
+		return httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("height must be between %d and %d", minTableHeight, maxTableHeight))
+	}
+	t.Width, t.Height = width, height
+	return nil
+}
+
+// itemSize returns dimensions of a given item
+func itemSize(it *TableItem) Size {
+	switch {
+	case it.Is(CardClass):
+		return Size{Width: cardWidth, Height: cardHeight}
+	case it.Is(ChipClass):
+		return Size{Width: chipWidth, Height: chipWidth}
+	case it.Is(DealerClass):
+		return Size{Width: dealerWidth, Height: dealerWidth}
+	}
+	return Size{}
+}
+
+// Clamp keeps a given item within the table bounds
+func (t *Table) Clamp(it *TableItem) {
+	size, item := t.Size(), itemSize(it)
+	it.X = clamp(it.X, 0, size.Width-item.Width)
+	it.Y = clamp(it.Y, 0, size.Height-item.Height)
+}
+
+func clamp(v int, lo int, hi int) int {
+	if v > hi {
+		v = hi
+	}
+	if v < lo {
+		v = lo
+	}
+	return v
+}
@@ -2,8 +2,11 @@ package poker
 
 import (
 	"encoding/json"
-	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
@@ -12,35 +15,111 @@ import (
 )
 
 const (
-	chipWidth = 70
+	// GrabTTL is how long an item stays grabbed if it was not released explicitly
+	GrabTTL = 5 * time.Second
+
+	// UnrevealWindow is how long a player can take back a card revealed by mistake
+	UnrevealWindow = 5 * time.Second
 )
 
 var (
-	// color: #3498DB; Blue
-	// color: #F1C40F; Yellow
+	// playerColors are colors of the seats followed by the spare ones players may recolor to
 	playerColors = []Color{
 		"#FF5733", // Red
 		"#9B59B6", // Purple
 		"#2ECC71", // Green
+		"#3498DB", // Blue
+		"#F1C40F", // Yellow
 	}
 )
 
+// PlayerColors returns the colors players get at tables
+func PlayerColors() []Color {
+	return append([]Color{}, playerColors...)
+}
+
+// SeenTime is a time that is safe to read and write concurrently:
+// users are shared by the user map and the tables they sit at
+type SeenTime struct {
+	v atomic.Value
+}
+
+// NewSeenTime creates a new instance of SeenTime
+func NewSeenTime(t time.Time) *SeenTime {
+	st := &SeenTime{}
+	st.Store(t)
+	return st
+}
+
+// Load returns the stored time
+func (st *SeenTime) Load() time.Time {
+	t, _ := st.v.Load().(time.Time)
+	return t
+}
+
+// Store stores a given time
+func (st *SeenTime) Store(t time.Time) { st.v.Store(t) }
+
+// MarshalJSON implements json.Marshaler
+func (st *SeenTime) MarshalJSON() ([]byte, error) { return json.Marshal(st.Load()) }
+
+// UnmarshalJSON implements json.Unmarshaler
+func (st *SeenTime) UnmarshalJSON(b []byte) error {
+	var t time.Time
+	if err := json.Unmarshal(b, &t); err != nil {
+		return err
+	}
+	st.Store(t)
+	return nil
+}
+
 // User represents a system user
 type User struct {
 	CreatedAt time.Time
 
+	// LastSeenAt is a time of the last authenticated request made by this user.
+	// Use SeenAt and Touch, it is nil for users loaded from older states
+	LastSeenAt *SeenTime
+
 	ID uuid.UUID
 
 	Name string
+
+	// Anonymous is set while the user has an auto generated name
+	Anonymous bool `json:",omitempty"`
 }
 
 // NewUser creates a new instance of a User
 func NewUser(iD uuid.UUID, name string, createdAt time.Time) *User {
 	return &User{
-		CreatedAt: createdAt,
-		ID:        iD,
-		Name:      name,
+		CreatedAt:  createdAt,
+		LastSeenAt: NewSeenTime(createdAt),
+		ID:         iD,
+		Name:       name,
+	}
+}
+
+// SeenAt returns the last time this user was active
+func (u *User) SeenAt() time.Time {
+	if u.LastSeenAt == nil {
+		return u.CreatedAt
 	}
+	if t := u.LastSeenAt.Load(); !t.IsZero() {
+		return t
+	}
+	return u.CreatedAt
+}
+
+// Touch records the activity of this user at a given time
+func (u *User) Touch(now time.Time) {
+	if u.LastSeenAt != nil {
+		u.LastSeenAt.Store(now)
+	}
+}
+
+// IsIdle checks if this user has not been active for longer than a given duration
+func (u *User) IsIdle(now time.Time, d time.Duration) bool {
+	return now.Sub(u.SeenAt()) > d
 }
 
 // Ranks represents all possible card ranks
@@ -68,6 +147,14 @@ const (
 	Clubs     Suit = "♣"
 )
 
+// IsValid checks if this is a known side
+func (s Side) IsValid() bool { return s == Cover || s == Face }
+
+// IsValid checks if this is a known suit
+func (s Suit) IsValid() bool {
+	return s == Spades || s == Hearts || s == Diamonds || s == Clubs
+}
+
 // Card represents a card in a game
 type Card struct {
 	Suit Suit   `json:"suit"`
@@ -75,6 +162,21 @@ type Card struct {
 	Side Side   `json:"side"`
 }
 
+// Validate checks that the fields of a card sent by a client are known values.
+// They may be blank: the card is covered or the item is not a card at all
+func (c *Card) Validate() error {
+	if c.Side != "" && !c.Side.IsValid() {
+		return httpx.NewError(http.StatusBadRequest, "bad side: "+string(c.Side))
+	}
+	if c.Suit != BlankSuit && !c.Suit.IsValid() {
+		return httpx.NewError(http.StatusBadRequest, "bad suit: "+string(c.Suit))
+	}
+	if c.Rank != "" && rankValue(c.Rank) == 0 {
+		return httpx.NewError(http.StatusBadRequest, "bad rank: "+c.Rank)
+	}
+	return nil
+}
+
 // Color is a card color
 type Color string
 
@@ -95,6 +197,39 @@ var chipsSet = []Chip{
 	{Color: Black, Val: 50},
 }
 
+// ChipsSet returns chips available on tables from the smallest to the biggest
+func ChipsSet() []Chip {
+	return append([]Chip{}, chipsSet...)
+}
+
+// MaxBankChips limits a number of chips of a single denomination in a table bank
+const MaxBankChips = 200
+
+// ParseBank parses comma separated numbers of bank chips of each denomination
+// from the smallest to the biggest, e.g. "100,50,50,20,10"
+func ParseBank(s string) ([]int, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != len(chipsSet) {
+		return nil, httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("bank must list %d denominations", len(chipsSet)))
+	}
+	bank := make([]int, len(parts))
+	total := 0
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 || n > MaxBankChips {
+			return nil, httpx.NewError(http.StatusBadRequest,
+				fmt.Sprintf("bad number of %s chips: %s", chipsSet[i].Color, p))
+		}
+		bank[i] = n
+		total += n
+	}
+	if total == 0 {
+		return nil, httpx.NewError(http.StatusBadRequest, "bank can not be empty")
+	}
+	return bank, nil
+}
+
 // Chip represents a poker chip
 type Chip struct {
 	Color Color `json:"color"`
@@ -106,12 +241,53 @@ type PushType string
 
 // Available pushes types
 const (
-	Refresh      PushType = "refresh"
-	PlayerJoined PushType = "player_joined"
-	UpdateItems  PushType = "update_items"
-	Disconnected PushType = "disconnected"
+	Refresh        PushType = "refresh"
+	PlayerJoined   PushType = "player_joined"
+	UpdateItems    PushType = "update_items"
+	Disconnected   PushType = "disconnect"
+	EconomyChanged PushType = "economy"
+	PlayersUpdated PushType = "players_updated"
+	PlayerFolded   PushType = "player_folded"
+	PlayerIdle     PushType = "player_idle"
 )
 
+// DisconnectReason tells a client why the server closed its push connection
+type DisconnectReason string
+
+// Disconnect reasons
+const (
+	// Superseded means another connection of the same player took over
+	Superseded DisconnectReason = "superseded"
+	// Kicked means the player has been removed from the table
+	Kicked DisconnectReason = "kicked"
+	// TableClosed means the table is gone
+	TableClosed DisconnectReason = "table_closed"
+	// Idle means the player has been removed from the table for being idle
+	Idle DisconnectReason = "idle"
+)
+
+// Stack represents an amount of chips a player has
+type Stack struct {
+	Amount int  `json:"amount"`
+	Hidden bool `json:"hidden"`
+}
+
+// Economy represents the current pot and players stacks on the table
+type Economy struct {
+	Pot int `json:"pot"`
+
+	Stacks map[uuid.UUID]*Stack `json:"stacks"`
+}
+
+// ApplyVisibilityRules hides amounts of other players stacks if they are hidden
+func (e *Economy) ApplyVisibilityRules(curUser *User) {
+	for id, st := range e.Stacks {
+		if st.Hidden && id != curUser.ID {
+			st.Amount = 0
+		}
+	}
+}
+
 // Push represents a push event that happens in the game and
 // carries objects to push to a client
 type Push struct {
@@ -120,6 +296,61 @@ type Push struct {
 	Items []*TableItem `json:"items"`
 
 	Players map[uuid.UUID]*Player `json:"players"`
+
+	Economy *Economy `json:"economy,omitempty"`
+
+	// Message is a human readable notice for the players
+	Message string `json:"message,omitempty"`
+
+	// Action tells what happened to the items, empty if unknown
+	Action ItemAction `json:"action,omitempty"`
+
+	// Reason tells why the connection is closed, only for disconnect pushes
+	Reason DisconnectReason `json:"reason,omitempty"`
+
+	// requestID is an id of the request that caused this push, it is only logged
+	requestID string
+}
+
+// ItemAction is what happened to items in a push, clients may use it for sounds and animations
+type ItemAction string
+
+// Item actions
+const (
+	Shown   ItemAction = "shown"
+	Taken   ItemAction = "taken"
+	Moved   ItemAction = "moved"
+	Flipped ItemAction = "flipped"
+	Dealt   ItemAction = "dealt"
+	Passed  ItemAction = "passed"
+	Mucked  ItemAction = "mucked"
+	Covered ItemAction = "covered"
+	Burned  ItemAction = "burned"
+)
+
+// WithAction sets an action of this push
+func (p *Push) WithAction(a ItemAction) *Push {
+	p.Action = a
+	return p
+}
+
+// RequestID returns an id of the request that caused this push, empty if unknown
+func (p *Push) RequestID() string {
+	return p.requestID
+}
+
+// ApplyVisibilityRules evaluates visibility of everything this push carries
+// for a given user. Must be called on a deep copy
+func (p *Push) ApplyVisibilityRules(curUser *User) {
+	for _, it := range p.Items {
+		it.ApplyVisibilityRules(curUser)
+	}
+	for _, pl := range p.Players {
+		pl.ApplyVisibilityRules(curUser)
+	}
+	if p.Economy != nil {
+		p.Economy.ApplyVisibilityRules(curUser)
+	}
 }
 
 // DeepCopy creates a deep copy of this push via serialisation
@@ -150,11 +381,41 @@ func NewPushPlayerJoined(players map[uuid.UUID]*Player, items ...*TableItem) *Pu
 	}
 }
 
+// NewPushEconomy returns a new push to send when the pot or stacks change
+func NewPushEconomy(e *Economy) *Push {
+	return &Push{Type: EconomyChanged, Economy: e}
+}
+
+// NewPushPlayers returns a new push to send when players info changes
+func NewPushPlayers(players map[uuid.UUID]*Player) *Push {
+	return &Push{Type: PlayersUpdated, Players: players}
+}
+
+// NewPushPlayerIdle returns a new push warning that an idle player is going to be removed
+func NewPushPlayerIdle(p *Player, in time.Duration) *Push {
+	return &Push{
+		Type:    PlayerIdle,
+		Message: fmt.Sprintf("%s will be removed in %s", p.ShownName(), in),
+	}
+}
+
+// NewPushPlayerFolded returns a new push to send when a player folds
+func NewPushPlayerFolded(players map[uuid.UUID]*Player, items ...*TableItem) *Push {
+	return &Push{
+		Type: PlayerFolded,
+
+		Items:   items,
+		Players: players,
+	}
+}
+
 // NewPushRefresh returns a new push instance to force a client refresh
 func NewPushRefresh() *Push { return &Push{Type: Refresh} }
 
-// NewPushDisconnected returns a new push instance to force a client refresh
-func NewPushDisconnected() *Push { return &Push{Type: Disconnected} }
+// NewPushDisconnected returns a new push instance telling a client why its connection is closed
+func NewPushDisconnected(reason DisconnectReason) *Push {
+	return &Push{Type: Disconnected, Reason: reason}
+}
 
 // PlayerList represents a list of players
 type PlayerList []*Player
@@ -181,7 +442,31 @@ type Player struct {
 	// Index represents player index in slots
 	Index int `json:"index"`
 
+	// Stack is an amount of chips this player has
+	Stack int `json:"stack"`
+
+	// HideStack hides the stack amount from other players
+	HideStack bool `json:"hide_stack"`
+
+	// DisplayName is a nickname of this player at this table only
+	DisplayName string `json:"display_name"`
+
+	// Folded is set when this player has folded in the current hand
+	Folded bool `json:"folded"`
+
+	// CardBack is a style of the covers others see of this player's cards, empty is the default one
+	CardBack string `json:"card_back"`
+
+	// Cards is a number of cards this player holds, everyone may see it
+	Cards int `json:"cards"`
+
 	updates chan *Push
+
+	// taps receive raw pushes dispatched to this player, for debugging
+	taps []chan *Push
+
+	// kickAt is when this idle player gets removed from the table, zero if not scheduled
+	kickAt time.Time
 }
 
 func newPlayer(u *User, c Color) *Player {
@@ -191,6 +476,75 @@ func newPlayer(u *User, c Color) *Player {
 	}
 }
 
+// IsOnline checks if this player is connected to the table updates
+func (p *Player) IsOnline() bool {
+	return p.updates != nil
+}
+
+// CheckIdle tracks a player that is offline and idle for longer than a given time:
+// the first time it schedules a removal in a given warning time and returns true
+// so that others get warned. Any activity cancels the scheduled removal
+func (p *Player) CheckIdle(now time.Time, idleAfter time.Duration, warning time.Duration) bool {
+	if p.IsOnline() || !p.IsIdle(now, idleAfter) {
+		p.kickAt = time.Time{}
+		return false
+	}
+	if !p.kickAt.IsZero() {
+		return false
+	}
+	p.kickAt = now.Add(warning)
+	return true
+}
+
+// IsIdleCheckDue checks if CheckIdle or ShouldKick would act on this player,
+// so that tables without idle players are checked without taking their write locks
+func (p *Player) IsIdleCheckDue(now time.Time, idleAfter time.Duration) bool {
+	idle := !p.IsOnline() && p.IsIdle(now, idleAfter)
+	if p.kickAt.IsZero() {
+		return idle // a warning is due
+	}
+	return !idle || p.ShouldKick(now) // the removal is either cancelled or due
+}
+
+// ShouldKick checks if a scheduled removal of this player is due
+func (p *Player) ShouldKick(now time.Time) bool {
+	return !p.kickAt.IsZero() && !now.Before(p.kickAt)
+}
+
+// CardBacks are the known styles of card covers
+var CardBacks = []string{"red", "blue", "green", "gray"}
+
+// IsCardBack checks if a given card back style is known, empty means the default one
+func IsCardBack(s string) bool {
+	if s == "" {
+		return true
+	}
+	for _, it := range CardBacks {
+		if it == s {
+			return true
+		}
+	}
+	return false
+}
+
+// ShownName returns a name of this player as it is shown at the table
+func (p *Player) ShownName() string {
+	if p.DisplayName != "" {
+		return p.DisplayName
+	}
+	return p.Name
+}
+
+// ApplyVisibilityRules hides this player's stack from others if it is hidden
+// and replaces the user name with the table nickname.
+// Must be called on a deep copy
+func (p *Player) ApplyVisibilityRules(curUser *User) {
+	if p.HideStack && p.ID != curUser.ID {
+		p.Stack = 0
+	}
+	p.Name = p.ShownName()
+}
+
 // Dispatch sends an update to this player
 func (p *Player) Dispatch(push *Push) *Player {
 	defer func() {
@@ -198,19 +552,36 @@ func (p *Player) Dispatch(push *Push) *Player {
 			logger.Error.Printf("Player.Dispatch name=%s panic: %s", p.Name, r)
 		}
 	}()
+	for _, tap := range p.taps {
+		select {
+		case tap <- push:
+		default:
+		}
+	}
 	if p.updates == nil {
 		return p
 	}
-	tm := time.After(40 * time.Millisecond)
+	// never block the broadcast: a consumer that fell too far behind loses the push
 	select {
 	case p.updates <- push:
-	case <-tm:
-		logger.Debug.Printf("user_name=%s Dispatch: timeout", p.Name)
+	default:
+		logger.Info.Printf("user_name=%s Dispatch: consumer is too slow, push dropped", p.Name)
 	}
 	return p
 }
 
-// Subscribe subscribes this player to async updates
+// DefaultUpdatesBuffer is a default number of pushes an update channel holds before
+// further pushes to a slow consumer get dropped
+const DefaultUpdatesBuffer = 16
+
+// NewUpdates makes a channel holding up to size pushes to subscribe to updates with
+func NewUpdates(size int) chan *Push {
+	return make(chan *Push, size)
+}
+
+// Subscribe subscribes this player to async updates. Pushes are dispatched
+// without blocking, so the channel should be buffered (see NewUpdates):
+// when it is full, pushes are dropped. A previous channel gets closed
 func (p *Player) Subscribe(updates chan *Push) *Player {
 	if p.updates != nil {
 		defer func() {
@@ -218,12 +589,25 @@ func (p *Player) Subscribe(updates chan *Push) *Player {
 				logger.Error.Printf("Player.Subscribe name=%s panic: %s", p.Name, r)
 			}
 		}()
-		close(p.updates)
+		p.Disconnect(Superseded)
 	}
 	p.updates = updates
 	return p
 }
 
+// Disconnect tells the active connection why it is being closed and unsubscribes it.
+// The reason is lost if the channel is full, the connection gets closed anyway
+func (p *Player) Disconnect(reason DisconnectReason) *Player {
+	if p.updates == nil {
+		return p
+	}
+	select {
+	case p.updates <- NewPushDisconnected(reason):
+	default:
+	}
+	return p.Unsubscribe()
+}
+
 // Unsubscribe unsubscribes active update channel
 func (p *Player) Unsubscribe() *Player {
 	if p.updates != nil {
@@ -233,6 +617,33 @@ func (p *Player) Unsubscribe() *Player {
 	return p
 }
 
+// Tap makes a given channel receive all pushes dispatched to this player as they are,
+// before visibility rules are applied. Pushes are dropped if the channel is full
+func (p *Player) Tap(ch chan *Push) *Player {
+	p.taps = append(append([]chan *Push{}, p.taps...), ch)
+	return p
+}
+
+// Untap stops sending pushes to a given channel
+func (p *Player) Untap(ch chan *Push) *Player {
+	taps := []chan *Push{}
+	for _, it := range p.taps {
+		if it != ch {
+			taps = append(taps, it)
+		}
+	}
+	p.taps = taps
+	return p
+}
+
+// UnsubscribeFrom unsubscribes a given channel if it is still the active one
+func (p *Player) UnsubscribeFrom(updates chan *Push) *Player {
+	if p.updates == updates {
+		p.Unsubscribe()
+	}
+	return p
+}
+
 // CardList is a list of cards
 type CardList []*Card
 
@@ -245,8 +656,12 @@ const (
 	ChipClass   Class = "chip"
 	DealerClass Class = "dealer"
 	PlayerClass Class = "player"
+	DeckClass   Class = "deck"
 )
 
+// DeckItemID is an id of the item that represents the whole deck pile when the deck is stacked
+const DeckItemID = -1
+
 // TableItemList is a list of TableItems
 type TableItemList []*TableItem
 
@@ -262,6 +677,16 @@ func (l TableItemList) Get(id int) *TableItem {
 	return nil
 }
 
+// Copy returns a list of copies of the items in this list
+func (l TableItemList) Copy() TableItemList {
+	res := make(TableItemList, 0, len(l))
+	for _, it := range l {
+		c := *it
+		res = append(res, &c)
+	}
+	return res
+}
+
 // TableItem represents a virtual object on the table
 type TableItem struct {
 	Card
@@ -277,15 +702,50 @@ type TableItem struct {
 	X  int `json:"x"`
 	Y  int `json:"y"`
 
+	// ZIndex is a transient client side z-index, e.g. while an item is being dragged
 	ZIndex int `json:"z_index"`
+
+	// Mucked is set for folded cards: nobody can see or take them until the next hand
+	Mucked bool `json:"mucked"`
+
+	// Burned is set for mucked cards that have been burned from the top of the deck
+	Burned bool `json:"burned,omitempty"`
+
+	// Count is a number of cards in the deck item
+	Count int `json:"count,omitempty"`
+
+	// Z is a stacking order of this item maintained by the server: items with bigger Z lie on top
+	Z int `json:"z"`
+
+	// GrabbedBy is an id of the user who is currently handling this item
+	GrabbedBy string `json:"grabbed_by"`
+
+	// ShownTo are ids of the users an owned card has been privately revealed to
+	ShownTo []string `json:"shown_to,omitempty"`
+
+	// ShownAt is when this card was last revealed to everyone
+	ShownAt *time.Time `json:"shown_at,omitempty"`
+
+	// Conjured cards were made up for tests or teaching rather than drawn from the deck
+	Conjured bool `json:"conjured,omitempty"`
+
+	// Pinned items stay where they are: they can't be moved, though cards can still be turned
+	Pinned bool `json:"pinned,omitempty"`
+
+	// CreatedAt is when this item was put on the table, nil for items saved before it was added
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+
+	grabbedUntil time.Time
 }
 
-// NewTableItem creates a new table item
-func NewTableItem(id int, x int, y int) *TableItem {
+// NewTableItem creates a new table item put on the table at a given time
+func NewTableItem(id int, x int, y int, now time.Time) *TableItem {
+	now = now.UTC()
 	return &TableItem{
-		ID: id,
-		X:  x,
-		Y:  y,
+		ID:        id,
+		X:         x,
+		Y:         y,
+		CreatedAt: &now,
 	}
 }
 
@@ -325,12 +785,15 @@ func (ti *TableItem) Take(u *User) *TableItem {
 	if ti.IsOwned() {
 		return ti // already taken
 	}
+	if ti.Mucked || ti.Burned {
+		return ti // folded and burned cards stay where they are
+	}
 	ti.OwnerID = u.ID.String()
 	return ti
 }
 
 // Shows card to everyone, disowns a card if it was taken by a player
-func (ti *TableItem) Show(u *User) error {
+func (ti *TableItem) Show(u *User, now time.Time) error {
 	// only cards can be shown
 	if !ti.Is(CardClass) {
 		return nil
@@ -340,10 +803,64 @@ func (ti *TableItem) Show(u *User) error {
 	}
 	ti.PrevOwnerID = ti.OwnerID
 	ti.OwnerID = ""
+	ti.ShownTo = nil
 	ti.Side = Face
+	shownAt := now.UTC()
+	ti.ShownAt = &shownAt
+	return nil
+}
+
+// Unreveal takes back a card revealed by mistake: it is covered and returned to
+// the player who revealed it provided nobody has taken it and the window has not passed
+func (ti *TableItem) Unreveal(u *User, now time.Time) error {
+	if !ti.Is(CardClass) || ti.IsOwned() || ti.Mucked || ti.PrevOwnerID != u.ID.String() {
+		return httpx.NewError(http.StatusForbidden, "you have not revealed this card")
+	}
+	if ti.ShownAt == nil || !now.Before(ti.ShownAt.Add(UnrevealWindow)) {
+		return httpx.NewError(http.StatusConflict, "too late to take the card back")
+	}
+	ti.OwnerID = ti.PrevOwnerID
+	ti.PrevOwnerID = ""
+	ti.ShownAt = nil
+	ti.Side = Cover
 	return nil
 }
 
+// ShowTo privately reveals a card owned by a given user to other users
+func (ti *TableItem) ShowTo(u *User, to []uuid.UUID) error {
+	if !ti.Is(CardClass) || !ti.IsOwnedBy(u.ID) {
+		return httpx.NewError(http.StatusForbidden, "not your card")
+	}
+	for _, id := range to {
+		if !ti.IsShownTo(id) {
+			ti.ShownTo = append(ti.ShownTo, id.String())
+		}
+	}
+	return nil
+}
+
+// IsShownTo checks if this card has been privately revealed to a given user
+func (ti *TableItem) IsShownTo(id uuid.UUID) bool {
+	for _, it := range ti.ShownTo {
+		if it == id.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Muck turns this card face down, disowns it and moves it to a given position
+func (ti *TableItem) Muck(x int, y int) *TableItem {
+	ti.OwnerID = ""
+	ti.PrevOwnerID = ""
+	ti.ShownTo = nil
+	ti.Side = Cover
+	ti.Mucked = true
+	ti.X = x
+	ti.Y = y
+	return ti
+}
+
 // Is defines if this item belongs to a specified class
 func (ti *TableItem) Is(cls Class) bool { return ti.Class == cls }
 
@@ -368,6 +885,9 @@ func (ti *TableItem) ApplyVisibilityRules(curUser *User) {
 	isOwnedBySomeoneElse := ti.IsOwned() && !ti.IsOwnedBy(curUser.ID)
 	if isOwnedBySomeoneElse {
 		ti.Side = Cover // if a card is owned by someone, others always see their card cover
+		if ti.IsShownTo(curUser.ID) {
+			ti.Side = Face // unless the owner has revealed it to this user
+		}
 	}
 	if ti.Side == Cover {
 		ti.Rank = ""
@@ -375,13 +895,35 @@ func (ti *TableItem) ApplyVisibilityRules(curUser *User) {
 	}
 }
 
+// UpdateFrom updates this item from a given one sent by a client.
+// Only X, Y and, for cards, Side can be changed. ZIndex is a client side hint and
+// server managed fields(Z, GrabbedBy, Mucked) are ignored. Any other difference
+// is rejected to surface client bugs instead of silently ignoring them.
+// Rank and suit are compared as the given user sees them.
 func (ti *TableItem) UpdateFrom(curUser *User, src *TableItem) error {
 	if ti.Class != src.Class {
-		return errors.New("attempt to update readonly field .Class")
+		return httpx.NewError(http.StatusBadRequest, "attempt to update readonly field .Class")
+	}
+	if ti.Chip != src.Chip {
+		return httpx.NewError(http.StatusBadRequest, "attempt to update readonly field .Chip")
+	}
+	visible := *ti
+	visible.ApplyVisibilityRules(curUser)
+	if visible.Rank != src.Rank || visible.Suit != src.Suit {
+		return httpx.NewError(http.StatusBadRequest, "attempt to update readonly fields .Rank or .Suit")
+	}
+	if !ti.Is(CardClass) && ti.Side != src.Side {
+		return httpx.NewError(http.StatusBadRequest, "only cards can be turned")
+	}
+	if ti.OwnerID != src.OwnerID || ti.PrevOwnerID != src.PrevOwnerID {
+		return httpx.NewError(http.StatusConflict, "item ownership has changed, refresh the item")
+	}
+	if ti.Pinned && (ti.X != src.X || ti.Y != src.Y) {
+		return httpx.NewError(http.StatusConflict, "item is pinned")
 	}
 	ti.X = src.X
 	ti.Y = src.Y
-	if ti.Side != src.Side {
+	if ti.Side != src.Side && !ti.Mucked {
 		if !ti.IsOwned() || ti.IsOwnedBy(curUser.ID) {
 			// card can be turned if it's not taken or by the owner only
 			ti.Side = src.Side
@@ -390,3 +932,44 @@ func (ti *TableItem) UpdateFrom(curUser *User, src *TableItem) error {
 	ti.ZIndex = src.ZIndex
 	return nil
 }
+
+// IsGrabbedByOther checks if this item is currently handled by someone else than a given user
+func (ti *TableItem) IsGrabbedByOther(u *User, now time.Time) bool {
+	if ti.GrabbedBy == "" || ti.GrabbedBy == u.ID.String() {
+		return false
+	}
+	return now.Before(ti.grabbedUntil)
+}
+
+// IsGrabExpired checks if this item is still marked as grabbed after the grab is over
+func (ti *TableItem) IsGrabExpired(now time.Time) bool {
+	return ti.GrabbedBy != "" && !now.Before(ti.grabbedUntil)
+}
+
+// CheckGrab returns an error if this item is handled by someone else
+func (ti *TableItem) CheckGrab(u *User, now time.Time) error {
+	if ti.IsGrabbedByOther(u, now) {
+		return httpx.NewError(http.StatusConflict, "item is being handled by another player")
+	}
+	return nil
+}
+
+// Grab marks this item as being handled by a given user until the grab expires
+func (ti *TableItem) Grab(u *User, now time.Time) error {
+	if err := ti.CheckGrab(u, now); err != nil {
+		return err
+	}
+	ti.GrabbedBy = u.ID.String()
+	ti.grabbedUntil = now.Add(GrabTTL)
+	return nil
+}
+
+// Release releases this item if it was grabbed by a given user or if the grab has expired
+func (ti *TableItem) Release(u *User, now time.Time) error {
+	if err := ti.CheckGrab(u, now); err != nil {
+		return err
+	}
+	ti.GrabbedBy = ""
+	ti.grabbedUntil = time.Time{}
+	return nil
+}
@@ -0,0 +1,264 @@
+package poker
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+func TestUserLastSeenAtPersists(t *testing.T) {
+	users := NewUserMapSyncronized()
+	u := newTestUser("alice")
+	u.Touch(epoch.Add(time.Hour))
+	users.Set(u.ID, u)
+
+	b, err := json.Marshal(users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := NewUserMapSyncronized()
+	if err := loaded.UnmarshalJSON(b); err != nil {
+		t.Fatal(err)
+	}
+	actual, found := loaded.Get(u.ID)
+	if !found {
+		t.Fatal("user is not loaded")
+	}
+	if !actual.SeenAt().Equal(epoch.Add(time.Hour)) {
+		t.Fatalf("seen at %s", actual.SeenAt())
+	}
+}
+
+func TestUserLoadedWithoutLastSeenAt(t *testing.T) {
+	id := uuid.New()
+	b := []byte(`{"` + id.String() + `":{"CreatedAt":"2024-01-02T03:04:05Z","ID":"` + id.String() + `","Name":"old"}}`)
+	users := NewUserMap()
+	if err := users.UnmarshalJSON(b); err != nil {
+		t.Fatal(err)
+	}
+	u, _ := users.Get(id)
+	if !u.SeenAt().Equal(epoch) {
+		t.Fatalf("an old user must be seen at its creation, got %s", u.SeenAt())
+	}
+	u.Touch(epoch.Add(time.Minute))
+	if !u.SeenAt().Equal(epoch.Add(time.Minute)) {
+		t.Fatalf("an old user must track its activity, got %s", u.SeenAt())
+	}
+}
+
+func TestLinkUsersSharesActivity(t *testing.T) {
+	u := newTestUser("alice")
+	table := newStartedTable(u)
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Table{}
+	if err := json.Unmarshal(b, loaded); err != nil {
+		t.Fatal(err)
+	}
+	users := NewUserMap()
+	users.Set(u.ID, u)
+
+	loaded.LinkUsers(users)
+	u.Touch(epoch.Add(time.Hour))
+
+	if p := loaded.Players[u.ID]; p.User != u || p.IsIdle(epoch.Add(time.Hour), time.Minute) {
+		t.Fatalf("a loaded player must see the activity of its user: %+v", p.User)
+	}
+}
+
+func TestGrabExpires(t *testing.T) {
+	alice := newTestUser("alice")
+	bob := newTestUser("bob")
+	item := NewTableItem(1, 0, 0, epoch).AsDealer()
+
+	if err := item.Grab(alice, epoch); err != nil {
+		t.Fatal(err)
+	}
+	if err := item.Grab(bob, epoch.Add(GrabTTL-time.Millisecond)); err == nil {
+		t.Fatal("an item grabbed by someone else must not be grabbed")
+	}
+	if item.IsGrabExpired(epoch.Add(GrabTTL - time.Millisecond)) {
+		t.Fatal("the grab has not expired yet")
+	}
+	if !item.IsGrabExpired(epoch.Add(GrabTTL)) {
+		t.Fatal("the grab must expire after GrabTTL")
+	}
+	if err := item.Grab(bob, epoch.Add(GrabTTL)); err != nil {
+		t.Fatalf("an expired grab must not block others: %s", err)
+	}
+	if err := item.Release(bob, epoch.Add(GrabTTL)); err != nil || item.GrabbedBy != "" {
+		t.Fatalf("release failed: %v %q", err, item.GrabbedBy)
+	}
+}
+
+func TestUpdateFromRejectsTamperedFields(t *testing.T) {
+	alice := newTestUser("alice")
+	card := func() *TableItem {
+		return NewTableItem(1, 10, 20, epoch).AsCard(&Card{Suit: Hearts, Rank: "Q", Side: Cover})
+	}
+	chip := func() *TableItem { return NewTableItem(2, 10, 20, epoch).AsChip(&Chip{Color: Red, Val: 5}) }
+
+	var tests = []struct {
+		name     string
+		expected int
+		item     *TableItem
+		tamper   func(*TableItem)
+	}{
+		{"class", http.StatusBadRequest, chip(), func(it *TableItem) { it.Class = DealerClass }},
+		{"chip value", http.StatusBadRequest, chip(), func(it *TableItem) { it.Val = 50 }},
+		{"chip color", http.StatusBadRequest, chip(), func(it *TableItem) { it.Color = Black }},
+		{"rank of a covered card", http.StatusBadRequest, card(), func(it *TableItem) { it.Rank = "A" }},
+		{"suit of a covered card", http.StatusBadRequest, card(), func(it *TableItem) { it.Suit = Spades }},
+		{"side of a chip", http.StatusBadRequest, chip(), func(it *TableItem) { it.Side = Face }},
+		{"owner", http.StatusConflict, card(), func(it *TableItem) { it.OwnerID = alice.ID.String() }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := *tt.item
+			src.ApplyVisibilityRules(alice)
+			src.X, src.Y = 100, 200
+			tt.tamper(&src)
+
+			err := tt.item.UpdateFrom(alice, &src)
+
+			httpErr, ok := err.(*httpx.Error)
+			if !ok || httpErr.Code != tt.expected {
+				t.Fatalf("expected status %d, got %v", tt.expected, err)
+			}
+			if tt.item.X != 10 || tt.item.Y != 20 {
+				t.Fatalf("a rejected update moved the item to %d,%d", tt.item.X, tt.item.Y)
+			}
+		})
+	}
+}
+
+func TestUpdateFromMovesAndTurns(t *testing.T) {
+	alice := newTestUser("alice")
+	item := NewTableItem(1, 10, 20, epoch).AsCard(&Card{Suit: Hearts, Rank: "Q", Side: Cover})
+	src := *item
+	src.ApplyVisibilityRules(alice)
+	src.X, src.Y, src.Side = 100, 200, Face
+
+	if err := item.UpdateFrom(alice, &src); err != nil {
+		t.Fatal(err)
+	}
+	if item.X != 100 || item.Y != 200 || item.Side != Face || item.Rank != "Q" {
+		t.Fatalf("unexpected item: %+v", item)
+	}
+}
+
+func TestNotifyAllSkipsStuckSubscriber(t *testing.T) {
+	const pushes = 10
+	stuck := newPlayer(newTestUser("stuck"), Red).Subscribe(NewUpdates(1))
+	alive := newPlayer(newTestUser("alive"), Blue).Subscribe(NewUpdates(pushes))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < pushes; i++ {
+			PlayerList{stuck, alive}.NotifyAll(NewPushRefresh())
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("a subscriber that does not drain its updates blocks the broadcast")
+	}
+	if n := len(alive.updates); n != pushes {
+		t.Fatalf("%d pushes delivered to a draining subscriber, expected %d", n, pushes)
+	}
+	if n := len(stuck.updates); n != 1 {
+		t.Fatalf("%d pushes buffered for a stuck subscriber, expected 1", n)
+	}
+}
+
+func TestItemCreatedAtPersists(t *testing.T) {
+	table := newStartedTable(newTestUser("alice"))
+	cp, err := table.DeepCopy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, it := range table.Items {
+		if it.CreatedAt == nil || !it.CreatedAt.Equal(*cp.Items[i].CreatedAt) {
+			t.Fatalf("item %d creation time is lost: %v", it.ID, cp.Items[i].CreatedAt)
+		}
+	}
+
+	old := []byte(`{"id":1,"class":"card","x":1,"y":2}`) // saved before created_at was added
+	it := &TableItem{}
+	if err := json.Unmarshal(old, it); err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(it)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "created_at") {
+		t.Fatalf("an unknown creation time must be omitted: %s", b)
+	}
+}
+
+func TestParseBank(t *testing.T) {
+	var tests = []struct {
+		name     string
+		expected []int
+		given    string
+	}{
+		{"all denominations", []int{100, 50, 0, 20, 10}, "100,50,0,20,10"},
+		{"spaces", []int{1, 2, 3, 4, 5}, "1, 2, 3, 4, 5"},
+		{"too few", nil, "1,2,3,4"},
+		{"too many", nil, "1,2,3,4,5,6"},
+		{"negative", nil, "1,2,-3,4,5"},
+		{"not a number", nil, "1,2,x,4,5"},
+		{"over the limit", nil, "1,2,3,4,201"},
+		{"empty", nil, "0,0,0,0,0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual, err := ParseBank(tt.given)
+			if tt.expected == nil {
+				if httpErr, ok := err.(*httpx.Error); !ok || httpErr.Code != http.StatusBadRequest {
+					t.Fatalf("expected a bad request, got %v %v", actual, err)
+				}
+				return
+			}
+			if err != nil || !reflect.DeepEqual(tt.expected, actual) {
+				t.Fatalf("expected %v, actual %v %v", tt.expected, actual, err)
+			}
+		})
+	}
+}
+
+func TestCardValidate(t *testing.T) {
+	var tests = []struct {
+		name  string
+		valid bool
+		given Card
+	}{
+		{"face card", true, Card{Suit: Clubs, Rank: "10", Side: Face}},
+		{"blank covered card", true, Card{Side: Cover}},
+		{"not a card", true, Card{}},
+		{"sideways", false, Card{Side: "sideways"}},
+		{"unknown suit", false, Card{Suit: "☂", Rank: "A", Side: Face}},
+		{"unknown rank", false, Card{Suit: Clubs, Rank: "1", Side: Face}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.given.Validate()
+			if tt.valid && err != nil {
+				t.Fatalf("expected valid, got %s", err)
+			}
+			if httpErr, ok := err.(*httpx.Error); !tt.valid && (!ok || httpErr.Code != http.StatusBadRequest) {
+				t.Fatalf("expected a bad request, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package poker
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+// Reservation is a seat kept for a player who has not joined yet
+type Reservation struct {
+	Name  string `json:"name"`
+	Index int    `json:"index"`
+	Color Color  `json:"color"`
+}
+
+// Reserve replaces reservations of this table by seats for given names, an empty list releases them all.
+// Reserved seats count as taken, so together with players they must fit in max
+func (t *Table) Reserve(names []string, max int) error {
+	if len(t.Players)+len(names) > max {
+		return httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("only %d seats are free", max-len(t.Players)))
+	}
+	prev := t.Reservations
+	t.Reservations = nil
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if name == "" || t.reservationOf(name) != nil {
+			t.Reservations = prev
+			return httpx.NewError(http.StatusBadRequest, "empty or duplicate name: "+name)
+		}
+		index := t.freeSeat()
+		t.Reservations = append(t.Reservations, &Reservation{Name: name, Index: index, Color: playerColors[index%len(playerColors)]})
+	}
+	return nil
+}
+
+// reservationOf returns a reservation for a given name if there is one
+func (t *Table) reservationOf(name string) *Reservation {
+	for _, r := range t.Reservations {
+		if strings.EqualFold(r.Name, name) {
+			return r
+		}
+	}
+	return nil
+}
+
+// claimReservation removes a reservation of a given user and returns its seat, -1 if there is none
+func (t *Table) claimReservation(u *User) int {
+	for i, r := range t.Reservations {
+		if strings.EqualFold(r.Name, u.Name) {
+			t.Reservations = append(t.Reservations[:i], t.Reservations[i+1:]...)
+			return r.Index
+		}
+	}
+	return -1
+}
+
+// IsFull checks if there is no seat for a given user: reserved seats are free only for whom they are reserved
+func (t *Table) IsFull(u *User, max int) bool {
+	if t.reservationOf(u.Name) != nil {
+		return false
+	}
+	return len(t.Players)+len(t.Reservations) >= max
+}
@@ -0,0 +1,61 @@
+package poker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+
+	"github.com/google/uuid"
+)
+
+// Spectator is a user that anonymous read-only spectators are represented by.
+// Nobody owns anything with its id, so spectators see public state only
+var Spectator = &User{ID: uuid.Nil, Name: "spectator"}
+
+// Share generates a new share token granting read-only access to this table.
+// Spectators connected by a previous token get disconnected
+func (t *Table) Share() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	t.Unshare()
+	t.ShareToken = base64.RawURLEncoding.EncodeToString(b)
+	return t.ShareToken, nil
+}
+
+// Unshare revokes the share token and disconnects all spectators
+func (t *Table) Unshare() {
+	t.ShareToken = ""
+	for _, p := range t.spectators {
+		p.Disconnect(Kicked)
+	}
+	t.spectators = nil
+}
+
+// IsShareToken checks if a given token grants access to this table
+func (t *Table) IsShareToken(token string) bool {
+	if t.ShareToken == "" || token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(t.ShareToken), []byte(token)) == 1
+}
+
+// AddSpectator subscribes a read-only spectator to the updates of this table
+func (t *Table) AddSpectator(updates chan *Push) *Player {
+	p := newPlayer(Spectator, "")
+	p.Subscribe(updates)
+	t.spectators = append(t.spectators, p)
+	return p
+}
+
+// RemoveSpectator unsubscribes a given spectator
+func (t *Table) RemoveSpectator(p *Player) {
+	for i, it := range t.spectators {
+		if it == p {
+			p.Unsubscribe()
+			t.spectators = append(t.spectators[:i], t.spectators[i+1:]...)
+			return
+		}
+	}
+}
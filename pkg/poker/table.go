@@ -1,19 +1,92 @@
 package poker
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/logger"
 )
 
+// deckSize is a number of cards in the deck, they always come first in the table items
+const deckSize = 52
+
+// DefaultBuyIn is an amount of chips a player gets on joining a table by default
+const DefaultBuyIn = 200
+
 // Table represents a poker table
 type Table struct {
 	// ID of this table
 	ID uuid.UUID `json:"id"`
 
+	// Name is a human readable name of this table
+	Name string `json:"name"`
+
+	// CreatedBy is an id of the user who created this table
+	CreatedBy uuid.UUID `json:"created_by"`
+
+	// Locked tables do not accept new players
+	Locked bool `json:"locked"`
+
+	// EmptySince is when the last player left the table, nil while anyone sits at it
+	EmptySince *time.Time `json:"empty_since,omitempty"`
+
+	// Template is the initial arrangement of this table
+	Template Template `json:"template"`
+
+	// ShareToken grants read-only access to this table to anyone who has it
+	ShareToken string `json:"share_token,omitempty"`
+
+	// spectators are read-only subscribers connected by the share token
+	spectators []*Player
+
+	// LastShuffledBy is an id of the user who shuffled the deck last
+	LastShuffledBy uuid.UUID `json:"last_shuffled_by"`
+
+	// LastShuffledAt is when the deck was shuffled last
+	LastShuffledAt time.Time `json:"last_shuffled_at"`
+
+	// LastDealtBy is an id of the user who dealt cards last
+	LastDealtBy uuid.UUID `json:"last_dealt_by"`
+
+	// LastDealtAt is when cards were dealt last
+	LastDealtAt time.Time `json:"last_dealt_at"`
+
+	// Reservations are seats the creator keeps for players by their names
+	Reservations []*Reservation `json:"reservations"`
+
+	// Waitlist is a queue of users waiting for a free seat
+	Waitlist []uuid.UUID `json:"waitlist"`
+
+	// ProvablyFair makes shuffles verifiable: the server commits to a seed before
+	// each shuffle and reveals it on the next one, e.g. with a new hand
+	ProvablyFair bool `json:"provably_fair"`
+
+	// ShuffleCommitment is a hash of the seed of the current deck order, see FairCommitment
+	ShuffleCommitment string `json:"shuffle_commitment,omitempty"`
+
+	// ShuffleSeed is the secret seed of the current deck order, never shown to clients
+	ShuffleSeed string `json:"shuffle_seed,omitempty"`
+
+	// RevealedSeed is the seed of the previous shuffle
+	RevealedSeed string `json:"revealed_seed,omitempty"`
+
+	// Version is bumped on each change pushed to the players
+	Version int `json:"version"`
+
+	// Felt is a background color of this table, empty means the default one
+	Felt Color `json:"felt"`
+
 	// Players represent players in this table
 	Players map[uuid.UUID]*Player `json:"players"`
 
@@ -26,13 +99,75 @@ type Table struct {
 	// Items on the table
 	Items TableItemList `json:"items"`
 
+	// BuyIn is an amount of chips each player gets on joining
+	BuyIn int `json:"buy_in"`
+
+	// MaxBuyIn limits an amount of a single re-buy, zero means unlimited
+	MaxBuyIn int `json:"max_buy_in"`
+
+	// SmallBlind and BigBlind are the stakes of this table, zeroes mean no blinds
+	SmallBlind int `json:"small_blind"`
+	BigBlind   int `json:"big_blind"`
+
+	// MaxBet limits a single bet, zero means unlimited
+	MaxBet int `json:"max_bet"`
+
+	// MaxHand limits a number of cards a single player can hold, zero means unlimited
+	MaxHand int `json:"max_hand"`
+
+	// Pot is an amount of chips bet in the current hand
+	Pot int `json:"pot"`
+
+	// Width and Height are the dimensions of the table, zeroes mean the default ones
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// DeckX and DeckY is the deck origin, zeroes mean the default one
+	DeckX int `json:"deck_x"`
+	DeckY int `json:"deck_y"`
+
+	// StackedDeck makes clients see the deck pile as a single item instead of individual cards
+	StackedDeck bool `json:"stacked_deck"`
+
+	// TopZ is the biggest Z of the items on this table
+	TopZ int `json:"top_z"`
+
+	// NextItemID is an id the next new item gets, ids are never reused
+	NextItemID int `json:"next_item_id"`
+
+	// PrivateStacks hides stacks of newly joined players from others
+	PrivateStacks bool `json:"private_stacks"`
+
 	lock sync.RWMutex
+
+	// changes are the recent changes of this table, see ChangedSince
+	changes []tableChange
+
+	// unshuffle is the state of the cards before the last shuffle
+	unshuffle *shuffleSnapshot
+
+	// clock tells the time to this table, nil is the wall clock
+	clock Clock
+
+	// onChange is called after successful updates of this table, see SetOnChange
+	onChange func()
 }
 
-// NewTable creates a new table instance
+// NewTable creates a new table instance with chipsN chips of each denomination in the bank
 func NewTable(id uuid.UUID, chipsN int) *Table {
+	bank := make([]int, len(chipsSet))
+	for i := range bank {
+		bank[i] = chipsN
+	}
+	return NewTableWithBank(id, bank)
+}
+
+// NewTableWithBank creates a new table instance with a given number of chips
+// of each denomination in the bank, see ParseBank
+func NewTableWithBank(id uuid.UUID, bank []int) *Table {
 	r := &Table{
 		ID:      id,
+		BuyIn:   DefaultBuyIn,
 		Players: map[uuid.UUID]*Player{},
 	}
 	for _, suit := range []Suit{Spades, Hearts, Diamonds, Clubs} {
@@ -40,107 +175,707 @@ func NewTable(id uuid.UUID, chipsN int) *Table {
 			r.Deck = append(r.Deck, &Card{Rank: rank, Suit: suit, Side: Cover})
 		}
 	}
-	for _, c := range chipsSet {
-		for i := 0; i < chipsN; i++ {
+	for j, c := range chipsSet {
+		for i := 0; j < len(bank) && i < bank[j]; i++ {
 			r.Chips = append(r.Chips, &Chip{Val: c.Val, Color: c.Color})
 		}
 	}
 	return r
 }
 
-func shuffle(items []*TableItem) {
+func shuffle(items []*TableItem, intn func(int) int) {
 	// O(n)
 	for i := len(items) - 1; i > 0; i-- {
-		j := rand.Intn(i)
+		j := intn(i)
 		items[i], items[j] = items[j], items[i]
 	}
 }
 
 // StartGame rearranges all the objects on the table to the initial state
 func (t *Table) StartGame() *Table {
-	id := 0
+	tpl := t.template()
+	now := t.Now()
+	t.DeckX, t.DeckY = tpl.deckX, tpl.deckY
 	for _, c := range t.Deck {
-		t.Items = append(t.Items, NewTableItem(id, 0, 0).AsCard(c))
-		id++
+		t.Items = append(t.Items, NewTableItem(t.nextID(), 0, 0, now).AsCard(c))
 	}
 	t.Shuffle()
-	x := 10
-	y := 20
+	x := tpl.bankX
+	y := tpl.bankY
 	for i, c := range t.Chips {
 		if i > 0 && t.Chips[i-1].Color != c.Color {
-			x = 10
+			x = tpl.bankX
 			y += 100
 		}
-		t.Items = append(t.Items, NewTableItem(id, x, y).AsChip(c))
+		t.Items = append(t.Items, NewTableItem(t.nextID(), x, y, now).AsChip(c))
 		x++
-		id++
 	}
-	t.Items = append(t.Items, NewTableItem(id, 595, 315).AsDealer())
+	t.Items = append(t.Items, NewTableItem(t.nextID(), tpl.dealerX, tpl.dealerY, now).AsDealer())
 	return t
 }
 
-// Shuffle shuffles cards on the table
+// shuffleSnapshot keeps the cards as they were before and right after a shuffle
+type shuffleSnapshot struct {
+	by    uuid.UUID
+	cards []TableItem
+	// shuffled are the cards as the shuffle left them: once any of them changes
+	// the shuffle can not be undone any more
+	shuffled []TableItem
+
+	seed       string
+	commitment string
+	revealed   string
+}
+
+// fairShuffle shuffles cards with a newly committed seed in the provably fair mode
+func (t *Table) fairShuffle(cards []*TableItem) error {
+	if !t.ProvablyFair {
+		shuffle(cards, rand.Intn)
+		return nil
+	}
+	if err := t.commitShuffle(); err != nil {
+		return err
+	}
+	return FairShuffle(cards, t.ShuffleSeed)
+}
+
+// copyCards returns copies of given cards
+func copyCards(cards []*TableItem) []TableItem {
+	res := make([]TableItem, len(cards))
+	for i, it := range cards {
+		res[i] = *it
+	}
+	return res
+}
+
+// Shuffle shuffles cards on the table. It can not be undone, see ShuffleBy.
+// Pinned cards stay where they are and keep their slots among the items
 func (t *Table) Shuffle() *Table {
-	cards := t.Items[0:52]
-	shuffle(cards)
-	x := 150
-	y := 20
+	t.unshuffle = nil
+	cards := TableItemList{}
+	for _, it := range t.Items[0:deckSize] {
+		if !it.Pinned {
+			cards = append(cards, it)
+		}
+	}
+	if err := t.fairShuffle(cards); err != nil {
+		logger.Error.Printf("table_id=%s provably fair shuffle: %s", t.ID, err)
+		shuffle(cards, rand.Intn)
+	}
+	t.gatherDeck(cards)
+	for i, it := range t.Items[0:deckSize] {
+		if !it.Pinned {
+			t.Items[i], cards = cards[0], cards[1:]
+		}
+	}
+	t.dropConjured()
+	return t
+}
+
+// dropConjured removes conjured cards from the table
+func (t *Table) dropConjured() {
+	items := TableItemList{}
+	for _, it := range t.Items {
+		if !it.Conjured {
+			items = append(items, it)
+		}
+	}
+	t.keepItems(items)
+}
+
+// ShuffleWithSeed puts the cards in a deterministic order given by a hex encoded seed,
+// see FairShuffle. It is meant for tests and demos
+func (t *Table) ShuffleWithSeed(seed string) error {
+	cards := t.Items[0:deckSize]
+	if err := FairShuffle(cards, seed); err != nil {
+		return httpx.NewError(http.StatusBadRequest, "bad seed: "+err.Error())
+	}
+	t.gatherDeck(cards)
+	return nil
+}
+
+// gatherDeck puts given cards face down to the deck pile in their order
+func (t *Table) gatherDeck(cards []*TableItem) {
+	x, y := t.deckOrigin()
 	for _, it := range cards {
 		it.X = x
 		it.Y = y
 		it.OwnerID = ""
 		it.PrevOwnerID = ""
+		it.ShownTo = nil
 		it.Side = Cover
+		it.Mucked = false
+		it.Burned = false
 		x++
 	}
+}
+
+// ShuffleBy shuffles cards on behalf of a given user. Unlike shuffles
+// of a new hand it can be undone, see UndoShuffle
+func (t *Table) ShuffleBy(u *User, now time.Time) *Table {
+	snap := &shuffleSnapshot{
+		by:         u.ID,
+		cards:      copyCards(t.Items[0:deckSize]),
+		seed:       t.ShuffleSeed,
+		commitment: t.ShuffleCommitment,
+		revealed:   t.RevealedSeed,
+	}
+	t.Shuffle()
+	snap.shuffled = copyCards(t.Items[0:deckSize])
+	t.unshuffle = snap
+	t.LastShuffledBy = u.ID
+	t.LastShuffledAt = now
 	return t
 }
 
-func (t *Table) generateChipsForPlayer(idx int) {
-	// add chips
+// isUndoable checks that no card has changed since the shuffle of this snapshot.
+// Updates that leave the cards intact, e.g. bets, do not prevent the undo
+func (snap *shuffleSnapshot) isUndoable(cards []*TableItem) bool {
+	if len(cards) != len(snap.shuffled) {
+		return false
+	}
+	for i, it := range cards {
+		if !reflect.DeepEqual(*it, snap.shuffled[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// UndoShuffle restores the cards as they were before the last shuffle.
+// It is only possible until any card changes, by the shuffler or the creator.
+// Provably fair shuffles can not be undone: the shuffle reveals the seed of
+// the previous order, so anyone could rebuild the restored deck
+func (t *Table) UndoShuffle(u *User) error {
+	snap := t.unshuffle
+	if snap == nil || !snap.isUndoable(t.Items[0:deckSize]) {
+		return httpx.NewError(http.StatusConflict, "nothing to undo")
+	}
+	if t.ProvablyFair {
+		return httpx.NewError(http.StatusConflict, "a provably fair shuffle can not be undone")
+	}
+	if snap.by != u.ID && !t.IsCreator(u) {
+		return httpx.NewError(http.StatusForbidden, "only the shuffler or the creator can undo a shuffle")
+	}
+	for i := range snap.cards {
+		it := snap.cards[i]
+		t.Items[i] = &it
+	}
+	t.ShuffleSeed, t.ShuffleCommitment, t.RevealedSeed = snap.seed, snap.commitment, snap.revealed
+	t.unshuffle = nil
+	return nil
+}
+
+// chipsSpread is a number of chips of each color laid out first when
+// an amount gets decomposed, so that a player always has some change
+var chipsSpread = map[Color]int{
+	Gray:  10,
+	Red:   8,
+	Blue:  5,
+	Green: 2,
+	Black: 1,
+}
+
+// DecomposeChips splits a given amount into counts of chips of each denomination.
+// Counts are aligned with the table denominations set: first the chips spread
+// is filled from the smallest chip up, then the remainder is taken greedily
+// starting from the biggest chip.
+func DecomposeChips(amount int) []int {
+	counts := make([]int, len(chipsSet))
+	if amount <= 0 {
+		return counts
+	}
+	for i, c := range chipsSet {
+		n := amount / c.Val
+		if n > chipsSpread[c.Color] {
+			n = chipsSpread[c.Color]
+		}
+		counts[i] += n
+		amount -= n * c.Val
+	}
+	for i := len(chipsSet) - 1; i >= 0; i-- {
+		n := amount / chipsSet[i].Val
+		counts[i] += n
+		amount -= n * chipsSet[i].Val
+	}
+	return counts
+}
+
+// GiveChips creates chips worth of a given amount next to the player's seat
+// and returns newly created items
+func (t *Table) GiveChips(p *Player, amount int) []*TableItem {
 	slots := [][]int{
 		{140, 545},
 		{890, 10},
 		{890, 545},
 	}
-	counts := map[Color]int{
-		Gray:  10,
-		Red:   8,
-		Blue:  5,
-		Green: 2,
-		Black: 1,
-	}
-	slot := slots[idx]
+	startIdx := len(t.Items)
+	now := t.Now()
+	slot := slots[p.Index%len(slots)]
 	x, y := slot[0], slot[1]
-	for _, ci := range chipsSet {
+	for i, n := range DecomposeChips(amount) {
+		ci := chipsSet[i]
 		if ci.Color == Green {
 			x = slot[0]
 			y = slot[1] + chipWidth
 		}
-		for i := 0; i < counts[ci.Color]; i++ {
-			item := NewTableItem(len(t.Items), x, y).AsChip(&ci)
+		for j := 0; j < n; j++ {
+			item := NewTableItem(t.nextID(), x, y, now).AsChip(&ci)
 			t.Items = append(t.Items, item)
 			x += 2
 		}
 		x += chipWidth
 	}
+	return t.Items[startIdx:]
 }
 
 // Join joins a user
 func (t *Table) Join(u *User) []*TableItem {
-	index := len(t.Players) % len(playerColors)
-	p := newPlayer(u, playerColors[index])
+	index := t.claimReservation(u)
+	if index < 0 {
+		index = t.freeSeat()
+	}
+	p := newPlayer(u, t.freeColor(playerColors[index%len(playerColors)]))
 	p.Index = index
 	p.Skin = fmt.Sprintf("player_%d", index)
 
+	p.HideStack = t.PrivateStacks
+
+	t.StopWaiting(u.ID)
 	t.Players[u.ID] = p
+	t.EmptySince = nil
 	startIdx := len(t.Items)
-	t.Items = append(t.Items, NewTableItem(len(t.Items), 0, 0).AsPlayer(p))
+	t.Items = append(t.Items, NewTableItem(t.nextID(), 0, 0, t.Now()).AsPlayer(p))
 
-	t.generateChipsForPlayer(index)
+	buyIn := t.BuyIn
+	if buyIn <= 0 {
+		buyIn = DefaultBuyIn
+	}
+	t.GiveChips(p, buyIn)
+	p.Stack = buyIn
 	return t.Items[startIdx:]
 }
 
+// SortedPlayers returns players ordered by their seats
+func (t *Table) SortedPlayers() []*Player {
+	res := make([]*Player, 0, len(t.Players))
+	for _, p := range t.Players {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Index < res[j].Index })
+	return res
+}
+
+// nextID allocates an id for a new item. Every item creating path must use it
+// so that ids stay unique, see syncNextID
+func (t *Table) nextID() int {
+	id := t.NextItemID
+	t.NextItemID++
+	return id
+}
+
+// syncNextID moves the id counter past the ids of all items, e.g. of tables
+// saved before the counter was persisted
+func (t *Table) syncNextID() {
+	for _, it := range t.Items {
+		if it.ID >= t.NextItemID {
+			t.NextItemID = it.ID + 1
+		}
+	}
+}
+
+// freeSeat returns the first seat index neither taken by any player nor reserved
+func (t *Table) freeSeat() int {
+	taken := map[int]bool{}
+	for _, p := range t.Players {
+		taken[p.Index] = true
+	}
+	for _, r := range t.Reservations {
+		taken[r.Index] = true
+	}
+	for i := range seats {
+		if !taken[i] {
+			return i
+		}
+	}
+	return len(t.Players) % len(seats)
+}
+
+// isColorTaken checks if a given color belongs to a player other than p
+func (t *Table) isColorTaken(c Color, p *Player) bool {
+	for _, it := range t.Players {
+		if it != p && it.Color == c {
+			return true
+		}
+	}
+	return false
+}
+
+// freeColor returns a preferred color if nobody has it or the next free one after it.
+// The preferred color is returned if all are taken
+func (t *Table) freeColor(preferred Color) Color {
+	start := 0
+	for i, c := range playerColors {
+		if c == preferred {
+			start = i
+		}
+	}
+	for i := range playerColors {
+		c := playerColors[(start+i)%len(playerColors)]
+		if !t.isColorTaken(c, nil) {
+			return c
+		}
+	}
+	return preferred
+}
+
+// Recolor changes the color of a given player to a requested one or, if it is empty,
+// to the next free one. Colors stay unique at the table
+func (t *Table) Recolor(p *Player, c Color) error {
+	if c == "" {
+		cur := -1
+		for i, it := range playerColors {
+			if it == p.Color {
+				cur = i
+			}
+		}
+		for i := 1; i <= len(playerColors); i++ {
+			next := playerColors[(cur+i)%len(playerColors)]
+			if next != p.Color && !t.isColorTaken(next, p) {
+				p.Color = next
+				return nil
+			}
+		}
+		return httpx.NewError(http.StatusConflict, "no free colors")
+	}
+	known := false
+	for _, it := range playerColors {
+		known = known || it == c
+	}
+	if !known {
+		return httpx.NewError(http.StatusBadRequest, "unknown color: "+string(c))
+	}
+	if t.isColorTaken(c, p) {
+		return httpx.NewError(http.StatusConflict, "color is taken")
+	}
+	p.Color = c
+	return nil
+}
+
+// Leave removes a player of a given user from the table: the player's cards are
+// returned to the top of the deck and the player object is removed
+func (t *Table) Leave(u *User) {
+	t.StopWaiting(u.ID)
+	p := t.Players[u.ID]
+	if p == nil {
+		return
+	}
+	x, y := t.deckOrigin()
+	x += len(t.DeckPile())
+	items := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(PlayerClass) && it.IsOwnedBy(u.ID) {
+			continue
+		}
+		if it.Is(CardClass) && it.IsOwnedBy(u.ID) {
+			it.OwnerID = ""
+			it.PrevOwnerID = ""
+			it.ShownTo = nil
+			it.Side = Cover
+			it.X, it.Y = x, y
+			x++
+		}
+		items = append(items, it)
+	}
+	t.keepItems(items)
+	p.Disconnect(Kicked)
+	delete(t.Players, u.ID)
+	if len(t.Players) == 0 {
+		now := t.Now()
+		t.EmptySince = &now
+	}
+}
+
+// ResetPlayer tidies up the seat of a given player: the player's cards are returned
+// to the top of the deck and the player's chips are replaced with the buy-in.
+// Chips are not owned, so the player's ones are those in the player's slot worth
+// no more than the player's stack: chips others bet or dropped there stay intact
+func (t *Table) ResetPlayer(p *Player) {
+	x, y := t.deckOrigin()
+	x += len(t.DeckPile())
+	zone := seatZone(p.Index)
+	removed := map[int]bool{}
+	left := p.Stack
+	for i := len(t.Items) - 1; i >= 0 && left > 0; i-- { // chips given last are the player's
+		it := t.Items[i]
+		if !it.Is(ChipClass) || it.Val > left || !zone.Contains(it.X+chipWidth/2, it.Y+chipWidth/2) {
+			continue
+		}
+		if it.GrabbedBy != "" && it.GrabbedBy != p.ID.String() {
+			continue
+		}
+		removed[it.ID] = true
+		left -= it.Val
+	}
+	items := TableItemList{}
+	for _, it := range t.Items {
+		if removed[it.ID] {
+			continue
+		}
+		if it.Is(CardClass) && it.IsOwnedBy(p.ID) {
+			it.OwnerID = ""
+			it.PrevOwnerID = ""
+			it.ShownTo = nil
+			it.Side = Cover
+			it.X, it.Y = x, y
+			x++
+		}
+		items = append(items, it)
+	}
+	t.keepItems(items)
+	buyIn := t.BuyIn
+	if buyIn <= 0 {
+		buyIn = DefaultBuyIn
+	}
+	t.GiveChips(p, buyIn)
+	p.Stack = buyIn
+}
+
+// Rebuy gives a player additional chips and adds them to the player's stack
+func (t *Table) Rebuy(p *Player, amount int) ([]*TableItem, error) {
+	if amount <= 0 {
+		return nil, httpx.NewError(http.StatusBadRequest, "amount must be positive")
+	}
+	if t.MaxBuyIn > 0 && amount > t.MaxBuyIn {
+		return nil, httpx.NewError(http.StatusBadRequest,
+			fmt.Sprintf("amount exceeds max buy-in of %d", t.MaxBuyIn))
+	}
+	items := t.GiveChips(p, amount)
+	p.Stack += amount
+	return items, nil
+}
+
+// BringToTop puts a given item on top of all other items
+func (t *Table) BringToTop(it *TableItem) *TableItem {
+	if it.Z == t.TopZ && it.Z != 0 {
+		return it // already on top
+	}
+	t.TopZ++
+	it.Z = t.TopZ
+	return it
+}
+
+// Economy returns the current pot and players stacks
+func (t *Table) Economy() *Economy {
+	e := &Economy{Pot: t.Pot, Stacks: map[uuid.UUID]*Stack{}}
+	for id, p := range t.Players {
+		e.Stacks[id] = &Stack{Amount: p.Stack, Hidden: p.HideStack}
+	}
+	return e
+}
+
+// SetStakes validates and sets blinds and max bet of this table
+func (t *Table) SetStakes(smallBlind int, bigBlind int, maxBet int) error {
+	if smallBlind < 0 || bigBlind < 0 || maxBet < 0 {
+		return httpx.NewError(http.StatusBadRequest, "stakes can not be negative")
+	}
+	if (smallBlind > 0 || bigBlind > 0) && (smallBlind == 0 || bigBlind == 0) {
+		return httpx.NewError(http.StatusBadRequest, "both blinds must be set")
+	}
+	if smallBlind > bigBlind {
+		return httpx.NewError(http.StatusBadRequest, "small blind is bigger than big blind")
+	}
+	t.SmallBlind, t.BigBlind, t.MaxBet = smallBlind, bigBlind, maxBet
+	return nil
+}
+
+// Bet moves a given amount from the player's stack to the pot
+func (t *Table) Bet(p *Player, amount int) error {
+	if amount <= 0 {
+		return httpx.NewError(http.StatusBadRequest, "bet must be positive")
+	}
+	if t.MaxBet > 0 && amount > t.MaxBet {
+		return httpx.NewError(http.StatusBadRequest, fmt.Sprintf("bet exceeds max bet of %d", t.MaxBet))
+	}
+	if amount > p.Stack {
+		return httpx.NewError(http.StatusBadRequest, "not enough chips")
+	}
+	p.Stack -= amount
+	t.Pot += amount
+	return nil
+}
+
+// NewHand gathers and shuffles all cards and gives the pot to a winner if any.
+// Returns the cards that have been gathered
+func (t *Table) NewHand(winner *Player) TableItemList {
+	if winner != nil {
+		winner.Stack += t.Pot
+		t.Pot = 0
+	}
+	for _, p := range t.Players {
+		p.Folded = false
+	}
+	t.Shuffle()
+	return t.Items[0:deckSize]
+}
+
+// CoverAll turns all face up cards nobody owns face down. Returns turned cards
+func (t *Table) CoverAll() TableItemList {
+	covered := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && !it.IsOwned() && it.Side == Face {
+			it.Side = Cover
+			covered = append(covered, it)
+		}
+	}
+	return covered
+}
+
+// ClearBoard gathers face up cards nobody owns back into the deck: they are shuffled
+// and put under the deck pile. Hands, chips and the muck are left as they are.
+// Returns cleared cards followed by the rest of the pile
+func (t *Table) ClearBoard() TableItemList {
+	cleared := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && !it.IsOwned() && it.Side == Face && !it.Mucked && !it.Pinned && !it.Conjured {
+			cleared = append(cleared, it)
+		}
+	}
+	if len(cleared) == 0 {
+		return cleared
+	}
+	shuffle(cleared, rand.Intn)
+	cards := append(cleared, t.DeckPile()...)
+	t.gatherDeck(cards)
+	return cards
+}
+
+// FlipOwned turns every card owned by a given user to a given side and returns the turned ones.
+// Mucked cards are left as they are
+func (t *Table) FlipOwned(u *User, side Side) TableItemList {
+	flipped := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && it.IsOwnedBy(u.ID) && !it.Mucked && it.Side != side {
+			it.Side = side
+			flipped = append(flipped, it)
+		}
+	}
+	return flipped
+}
+
+// HasExpiredGrabs checks if any item is still marked as grabbed after its grab is over
+func (t *Table) HasExpiredGrabs(now time.Time) bool {
+	for _, it := range t.Items {
+		if it.IsGrabExpired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// ReleaseExpiredGrabs clears the grabs that are over but were never released. Returns released items
+func (t *Table) ReleaseExpiredGrabs(now time.Time) TableItemList {
+	released := TableItemList{}
+	for _, it := range t.Items {
+		if it.IsGrabExpired(now) {
+			it.GrabbedBy = ""
+			released = append(released, it)
+		}
+	}
+	return released
+}
+
+// MuckPile returns the cards in the muck
+func (t *Table) MuckPile() TableItemList {
+	res := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && it.Mucked && !it.Burned {
+			res = append(res, it)
+		}
+	}
+	return res
+}
+
+// MuckCard puts a card face down on top of the muck pile. Mucked cards
+// stay there until the next shuffle gathers them back into the deck
+func (t *Table) MuckCard(it *TableItem) *TableItem {
+	if it.Mucked {
+		return it
+	}
+	it.Muck(muckZone.X+len(t.MuckPile()), muckZone.Y)
+	t.BringToTop(it)
+	return it
+}
+
+// BurnPile returns the burned cards
+func (t *Table) BurnPile() TableItemList {
+	res := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && it.Burned {
+			res = append(res, it)
+		}
+	}
+	return res
+}
+
+// Burn puts the top card of the deck face down on the burn pile. Burned cards are
+// mucked: nobody can see, take or get them dealt until the next shuffle
+func (t *Table) Burn() (*TableItem, error) {
+	it := t.DeckTop()
+	if it == nil {
+		return nil, httpx.NewError(http.StatusConflict, "the deck is empty")
+	}
+	zone := t.burnZone()
+	it.Muck(zone.X+len(t.BurnPile()), zone.Y)
+	it.Burned = true
+	t.BringToTop(it)
+	return it, nil
+}
+
+// Fold mucks all cards of a given player face down. Returns mucked cards
+func (t *Table) Fold(p *Player) TableItemList {
+	mucked := TableItemList{}
+	for _, it := range t.Items {
+		if it.Is(CardClass) && it.IsOwnedBy(p.ID) {
+			mucked = append(mucked, t.MuckCard(it))
+		}
+	}
+	p.Folded = true
+	p.Cards = 0
+	return mucked
+}
+
+// ApplyVisibilityRules evaluates visibility of items and players on this table
+// for a given user. Must be called on a deep copy
+func (t *Table) ApplyVisibilityRules(curUser *User) {
+	for _, it := range t.Items {
+		it.ApplyVisibilityRules(curUser)
+	}
+	for _, p := range t.Players {
+		p.ApplyVisibilityRules(curUser)
+	}
+	if !t.IsCreator(curUser) {
+		t.ShareToken = "" // only the creator manages sharing
+	}
+	t.ShuffleSeed = ""
+}
+
+var feltValidator = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+// ParseFelt validates a given table felt color given as #RRGGBB hex string
+func ParseFelt(s string) (Color, error) {
+	if s == "" {
+		return "", nil
+	}
+	if !feltValidator.MatchString(s) {
+		return "", httpx.NewError(http.StatusBadRequest, "felt must be a #RRGGBB color")
+	}
+	return Color(strings.ToUpper(s)), nil
+}
+
+// IsCreator checks if a given user has created this table
+func (t *Table) IsCreator(u *User) bool { return t.CreatedBy == u.ID }
+
 // OtherPlayers returns all players but a given
 func (t *Table) OtherPlayers(cur *User) PlayerList {
 	var others PlayerList
@@ -166,25 +901,124 @@ func (t *Table) DeepCopy() (*Table, error) {
 	return dest, nil
 }
 
-// ReadLock performs thread-safe read of this object
-func (t *Table) ReadLock(fn func(*Table) error) error {
+// UnmarshalJSON implements json.Unmarshaler interface.
+// It repairs duplicate item ids as lookups rely on their uniqueness
+func (t *Table) UnmarshalJSON(b []byte) error {
+	type table Table // prevents recursive calls of UnmarshalJSON
+	if err := json.Unmarshal(b, (*table)(t)); err != nil {
+		return err
+	}
+	t.syncNextID()
+	t.repairDuplicateIDs()
+	return nil
+}
+
+// repairDuplicateIDs assigns new ids to all items but the first one sharing the same id
+func (t *Table) repairDuplicateIDs() {
+	seen := map[int]bool{}
+	for _, it := range t.Items {
+		if !seen[it.ID] {
+			seen[it.ID] = true
+			continue
+		}
+		id := t.nextID()
+		logger.Error.Printf("table_id=%s duplicate item id=%d class=%s reassigned_id=%d",
+			t.ID, it.ID, it.Class, id)
+		it.ID = id
+		seen[it.ID] = true
+	}
+}
+
+// LinkUsers points players to the users of a given map: a loaded table
+// has its own copies of the users that would never see their activity.
+// It is meant to be called before the table gets shared
+func (t *Table) LinkUsers(users UserMap) {
+	for id, p := range t.Players {
+		if u, found := users.Get(id); found {
+			p.User = u
+		}
+	}
+}
+
+// ErrNotMember is returned to users acting on a table they have not joined
+var ErrNotMember = httpx.NewError(http.StatusForbidden, "you are not at the table")
+
+// RequireMember returns ErrNotMember unless a user with a given id sits at this table
+func (t *Table) RequireMember(userID uuid.UUID) error {
+	if t.Players[userID] == nil {
+		return ErrNotMember
+	}
+	return nil
+}
+
+// ReadLock performs thread-safe read of this object.
+// fn is not called if ctx is already done by the time the lock is acquired
+func (t *Table) ReadLock(ctx context.Context, fn func(*Table) error) error {
 	t.lock.RLock()
 	defer t.lock.RUnlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return fn(t)
 }
 
-// Update performs thread-safe update of this object
-func (t *Table) Update(fn func(*Table) error) error {
+// SetOnChange sets a function called under the lock after each successful update
+// of this table, it must not block. nil disables it
+func (t *Table) SetOnChange(fn func()) {
+	t.onChange = fn
+}
+
+// Update performs thread-safe update of this object.
+// fn is not called if ctx is already done by the time the lock is acquired:
+// nobody waits for the result, so the table is left intact
+func (t *Table) Update(ctx context.Context, fn func(*Table) error) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
-	return fn(t)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := fn(t)
+	t.countCards()
+	if err != nil {
+		return err
+	}
+	if t.onChange != nil {
+		t.onChange()
+	}
+	return nil
 }
 
-// NotifyOthers notifies all other players at the table except a given one
-func (t *Table) NotifyOthers(cur *User, p *Push) {
-	t.lock.RLock()
-	others := t.OtherPlayers(cur)
-	t.lock.RUnlock()
+// NotifyPlayers sends a push to the players with given ids only
+func (t *Table) NotifyPlayers(ctx context.Context, ids []uuid.UUID, p *Push) {
+	if p.requestID == "" {
+		p.requestID = httpx.RequestID(ctx)
+	}
+	t.lock.Lock()
+	t.recordChange(p)
+	recipients := PlayerList{}
+	for _, id := range ids {
+		if pl := t.Players[id]; pl != nil {
+			recipients = append(recipients, pl)
+		}
+	}
+	t.lock.Unlock()
+
+	recipients.NotifyAll(p)
+}
+
+// NotifyOthers notifies all other players at the table except a given one.
+// The push is delivered even if ctx is done: it reflects a change that has already
+// been made, so dropping it would leave the others out of sync
+func (t *Table) NotifyOthers(ctx context.Context, cur *User, p *Push) {
+	if p.requestID == "" {
+		p.requestID = httpx.RequestID(ctx)
+	}
+	t.lock.Lock()
+	t.recordChange(p)
+	others := append(t.OtherPlayers(cur), t.spectators...)
+	t.lock.Unlock()
 
+	logger.Debug.Printf("request_id=%s table_id=%s push=%s recipients=%d",
+		p.requestID, t.ID, p.Type, len(others))
 	others.NotifyAll(p)
 }
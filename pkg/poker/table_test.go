@@ -0,0 +1,644 @@
+package poker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// epoch is a fixed time tests start at
+var epoch = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// fixedClock always tells the same time
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+func newTestUser(name string) *User {
+	return NewUser(uuid.New(), name, epoch)
+}
+
+// newStartedTable is a table with the game started and given users seated
+func newStartedTable(users ...*User) *Table {
+	t := NewTable(uuid.New(), 10).StartGame()
+	for _, u := range users {
+		t.Join(u)
+	}
+	return t
+}
+
+func chipsValue(items []*TableItem) int {
+	sum := 0
+	for _, it := range items {
+		if it.Is(ChipClass) {
+			sum += it.Val
+		}
+	}
+	return sum
+}
+
+func TestDecomposeChips(t *testing.T) {
+	var tests = []struct {
+		name     string
+		expected []int
+		given    int
+	}{
+		{"zero", []int{0, 0, 0, 0, 0}, 0},
+		{"negative", []int{0, 0, 0, 0, 0}, -5},
+		{"only small change", []int{7, 0, 0, 0, 0}, 7},
+		{"spread is filled from the smallest", []int{10, 4, 0, 0, 0}, 30},
+		{"exact spread", []int{10, 8, 5, 2, 1}, 200},
+		{"remainder goes to the biggest", []int{10, 8, 5, 2, 17}, 1000},
+		{"remainder uses smaller chips", []int{10, 8, 5, 3, 1}, 225},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			actual := DecomposeChips(tt.given)
+			if !reflect.DeepEqual(tt.expected, actual) {
+				t.Fatalf("expected %v, actual %v", tt.expected, actual)
+			}
+		})
+	}
+}
+
+func TestDecomposeChipsKeepsAmount(t *testing.T) {
+	for amount := 0; amount <= 2000; amount++ {
+		sum := 0
+		for i, n := range DecomposeChips(amount) {
+			if n < 0 {
+				t.Fatalf("%d: negative count of %s chips", amount, chipsSet[i].Color)
+			}
+			sum += n * chipsSet[i].Val
+		}
+		if sum != amount {
+			t.Fatalf("%d: chips are worth %d", amount, sum)
+		}
+	}
+}
+
+func TestJoinGivesBuyIn(t *testing.T) {
+	table := NewTable(uuid.New(), 10).StartGame()
+	table.BuyIn = 350
+	u := newTestUser("alice")
+
+	created := table.Join(u)
+
+	if !created[0].Is(PlayerClass) {
+		t.Fatalf("the player item must go first: %+v", created[0])
+	}
+	if v := chipsValue(created); v != 350 {
+		t.Fatalf("buy-in chips are worth %d", v)
+	}
+	if p := table.Players[u.ID]; p.Stack != 350 {
+		t.Fatalf("stack is %d", p.Stack)
+	}
+	for _, it := range created {
+		if table.Items.Get(it.ID) != it {
+			t.Fatalf("item %d is not on the table", it.ID)
+		}
+	}
+}
+
+func TestUnmarshalRepairsDuplicateIDs(t *testing.T) {
+	table := newStartedTable(newTestUser("alice"))
+	first, dup := table.Items[0], table.Items[len(table.Items)-1]
+	dup.ID = first.ID
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &Table{}
+	if err := json.Unmarshal(b, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := map[int]bool{}
+	for _, it := range loaded.Items {
+		if ids[it.ID] {
+			t.Fatalf("id %d is still duplicated", it.ID)
+		}
+		ids[it.ID] = true
+	}
+	if got := loaded.Items.Get(first.ID); got.Class != first.Class || got.Rank != first.Rank || got.Suit != first.Suit {
+		t.Fatalf("the first item must keep its id, got %+v", got)
+	}
+	repaired := loaded.Items[len(loaded.Items)-1]
+	if repaired.ID == first.ID || repaired.Class != dup.Class {
+		t.Fatalf("the duplicate must get a new id: %+v", repaired)
+	}
+	if loaded.NextItemID <= repaired.ID {
+		t.Fatalf("next item id %d would reuse %d", loaded.NextItemID, repaired.ID)
+	}
+}
+
+// deckOrder returns ids of the deck cards in their order
+func deckOrder(t *Table) []int {
+	ids := []int{}
+	for _, it := range t.Items[0:deckSize] {
+		ids = append(ids, it.ID)
+	}
+	return ids
+}
+
+func TestUndoShuffle(t *testing.T) {
+	alice := newTestUser("alice")
+	bob := newTestUser("bob")
+	table := newStartedTable(alice, bob)
+	if err := table.UndoShuffle(alice); err == nil {
+		t.Fatal("the shuffle of a game start must not be undone")
+	}
+	before := deckOrder(table)
+
+	table.ShuffleBy(bob, epoch)
+	if err := table.Bet(table.Players[alice.ID], 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := table.UndoShuffle(alice); err == nil {
+		t.Fatal("only the shuffler or the creator may undo a shuffle")
+	}
+	if err := table.UndoShuffle(bob); err != nil {
+		t.Fatalf("updates not touching the cards must not prevent the undo: %s", err)
+	}
+	if !reflect.DeepEqual(before, deckOrder(table)) {
+		t.Fatal("the deck order is not restored")
+	}
+	if err := table.UndoShuffle(bob); err == nil {
+		t.Fatal("a shuffle must be undone once")
+	}
+}
+
+func TestUndoShuffleAfterCardsChange(t *testing.T) {
+	alice := newTestUser("alice")
+	table := newStartedTable(alice)
+
+	table.ShuffleBy(alice, epoch)
+	table.DeckPile()[0].Take(alice)
+	if err := table.UndoShuffle(alice); err == nil {
+		t.Fatal("a shuffle must not be undone once a card has been taken")
+	}
+
+	table.ShuffleBy(alice, epoch)
+	table.NewHand(nil)
+	if err := table.UndoShuffle(alice); err == nil {
+		t.Fatal("the shuffle of a new hand must not be undone")
+	}
+}
+
+func TestSortedPlayersFollowSeats(t *testing.T) {
+	alice, bob, carol, dave := newTestUser("alice"), newTestUser("bob"), newTestUser("carol"), newTestUser("dave")
+	table := newStartedTable(alice, bob, carol)
+	table.Leave(bob)
+	table.Join(dave) // takes the seat bob has left
+
+	expected := []uuid.UUID{alice.ID, dave.ID, carol.ID}
+	for i := 0; i < 50; i++ { // maps are iterated in random order
+		actual := []uuid.UUID{}
+		for _, p := range table.SortedPlayers() {
+			actual = append(actual, p.ID)
+		}
+		if !reflect.DeepEqual(expected, actual) {
+			t.Fatalf("expected %v, actual %v", expected, actual)
+		}
+	}
+}
+
+func TestCoverAllChangesOnlyUnownedCards(t *testing.T) {
+	alice := newTestUser("alice")
+	table := newStartedTable(alice)
+	pile := table.DeckPile()
+	board, hand, covered := pile[0], pile[1], pile[2]
+	board.Side = Face
+	hand.Take(alice)
+	hand.Side = Face
+	before := map[int]TableItem{}
+	for _, it := range table.Items {
+		before[it.ID] = *it
+	}
+
+	turned := table.CoverAll()
+
+	if len(turned) != 1 || turned[0].ID != board.ID {
+		t.Fatalf("expected only the board card to turn, got %v", turned)
+	}
+	for _, it := range table.Items {
+		expected := before[it.ID]
+		if it.ID == board.ID {
+			expected.Side = Cover
+		}
+		if !reflect.DeepEqual(expected, *it) {
+			t.Fatalf("item %d changed: %+v", it.ID, it)
+		}
+	}
+	if covered.Side != Cover || hand.Side != Face {
+		t.Fatalf("unexpected sides: hand %s covered %s", hand.Side, covered.Side)
+	}
+}
+
+func TestFlipOwnedBothWays(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	table := newStartedTable(alice, bob)
+	pile := table.DeckPile()
+	mine := TableItemList{pile[0].Take(alice), pile[1].Take(alice)}
+	mucked := pile[2].Take(alice)
+	table.MuckCard(mucked)
+	theirs := pile[3].Take(bob)
+	for _, it := range mine {
+		it.Side = Cover
+	}
+
+	if flipped := table.FlipOwned(alice, Face); len(flipped) != len(mine) {
+		t.Fatalf("%d cards turned face up, expected %d", len(flipped), len(mine))
+	}
+	for _, it := range mine {
+		if it.Side != Face {
+			t.Fatalf("card %d is not face up", it.ID)
+		}
+	}
+	if flipped := table.FlipOwned(alice, Face); len(flipped) != 0 {
+		t.Fatalf("cards already face up are turned again: %v", flipped)
+	}
+	if mucked.Side != Cover || theirs.Side != Cover {
+		t.Fatalf("unexpected sides: mucked %s, bob's %s", mucked.Side, theirs.Side)
+	}
+
+	if flipped := table.FlipOwned(alice, Cover); len(flipped) != len(mine) {
+		t.Fatalf("%d cards turned face down, expected %d", len(flipped), len(mine))
+	}
+	for _, it := range mine {
+		if it.Side != Cover {
+			t.Fatalf("card %d is not face down", it.ID)
+		}
+	}
+}
+
+func TestUpdateCancelledWhileWaitingForLock(t *testing.T) {
+	table := newStartedTable()
+	ctx, cancel := context.WithCancel(context.Background())
+	locked := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		_ = table.Update(context.Background(), func(*Table) error {
+			close(locked)
+			<-release
+			return nil
+		})
+	}()
+	<-locked
+
+	result := make(chan error)
+	called := false
+	go func() {
+		result <- table.Update(ctx, func(t *Table) error {
+			called = true
+			t.Name = "changed"
+			return nil
+		})
+	}()
+	cancel() // the requester is gone while the update waits for the lock
+	close(release)
+
+	if err := <-result; err != context.Canceled {
+		t.Fatalf("expected %v, actual %v", context.Canceled, err)
+	}
+	if called || table.Name != "" {
+		t.Fatal("a cancelled update is applied")
+	}
+	if err := table.ReadLock(ctx, func(*Table) error {
+		t.Fatal("a cancelled read is done")
+		return nil
+	}); err != context.Canceled {
+		t.Fatalf("expected %v, actual %v", context.Canceled, err)
+	}
+}
+
+func TestNotifyOthersDeliversAfterCancel(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	table := newStartedTable(alice, bob)
+	updates := NewUpdates(1)
+	table.Players[bob.ID].Subscribe(updates)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	table.NotifyOthers(ctx, alice, NewPushRefresh())
+
+	select {
+	case p := <-updates:
+		if p.Type != Refresh {
+			t.Fatalf("unexpected push %s", p.Type)
+		}
+	default:
+		t.Fatal("a push of an applied change is dropped after the request is cancelled")
+	}
+}
+
+func TestStartGameLaysOutBank(t *testing.T) {
+	bank := []int{20, 10, 0, 4, 1} // 20*1 + 10*5 + 4*25 + 1*50
+
+	table := NewTableWithBank(uuid.New(), bank).StartGame()
+
+	if v := chipsValue(table.Items); v != 220 {
+		t.Fatalf("the bank is worth %d, expected 220", v)
+	}
+	counts := map[Color]int{}
+	for _, it := range table.Items {
+		if it.Is(ChipClass) {
+			counts[it.Color]++
+		}
+	}
+	for i, c := range chipsSet {
+		if counts[c.Color] != bank[i] {
+			t.Fatalf("%d %s chips, expected %d", counts[c.Color], c.Color, bank[i])
+		}
+	}
+}
+
+func TestUpdateCallsOnChange(t *testing.T) {
+	table := newStartedTable()
+	changes := 0
+	table.SetOnChange(func() { changes++ })
+	ctx, cancel := context.WithCancel(context.Background())
+
+	_ = table.Update(ctx, func(*Table) error { return nil })
+	_ = table.Update(ctx, func(*Table) error { return errors.New("rejected") })
+	cancel()
+	_ = table.Update(ctx, func(*Table) error { return nil })
+
+	if changes != 1 {
+		t.Fatalf("on change is called %d times, expected only after the successful update", changes)
+	}
+}
+
+func TestResetPlayerChangesOnlyTargetedPlayer(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	table := newStartedTable(alice, bob)
+	p := table.Players[alice.ID]
+	pile := table.DeckPile()
+	aliceCard := pile[0].Take(alice)
+	bobCard := pile[1].Take(bob)
+	zone := seatZone(p.Index)
+	dropped := table.Items[deckSize] // a bank chip bob dropped at alice's seat
+	if !dropped.Is(ChipClass) {
+		t.Fatalf("not a chip: %+v", dropped)
+	}
+	dropped.X, dropped.Y = zone.X, zone.Y
+	aliceChips := map[int]bool{}
+	for _, it := range table.Items {
+		if it.Is(ChipClass) && it != dropped && zone.Contains(it.X+chipWidth/2, it.Y+chipWidth/2) {
+			aliceChips[it.ID] = true
+		}
+	}
+	before := map[int]TableItem{}
+	for _, it := range table.Items {
+		before[it.ID] = *it
+	}
+
+	table.ResetPlayer(p)
+
+	inZone := []*TableItem{}
+	for _, it := range table.Items {
+		if aliceChips[it.ID] {
+			t.Fatalf("alice's chip %d is not removed", it.ID)
+		}
+		if it.Is(ChipClass) && zone.Contains(it.X+chipWidth/2, it.Y+chipWidth/2) {
+			inZone = append(inZone, it)
+		}
+		prev, found := before[it.ID]
+		if !found || it == aliceCard {
+			continue // alice's new chips and returned card
+		}
+		if !reflect.DeepEqual(prev, *it) {
+			t.Fatalf("item %d of someone else changed: %+v", it.ID, it)
+		}
+	}
+	if v := chipsValue(inZone); v != DefaultBuyIn+dropped.Val {
+		t.Fatalf("chips at alice's seat are worth %d, expected the buy-in and the dropped chip", v)
+	}
+	if aliceCard.OwnerID != "" || aliceCard.Side != Cover || bobCard.OwnerID != bob.ID.String() {
+		t.Fatalf("unexpected cards: alice's %+v bob's %+v", aliceCard, bobCard)
+	}
+	if p.Stack != DefaultBuyIn || table.Players[bob.ID].Stack != DefaultBuyIn {
+		t.Fatalf("unexpected stacks: alice %d bob %d", p.Stack, table.Players[bob.ID].Stack)
+	}
+}
+
+func TestEmptySinceSurvivesRestart(t *testing.T) {
+	alice := newTestUser("alice")
+	table := newStartedTable(alice)
+	table.SetClock(fixedClock(epoch))
+	if b, _ := json.Marshal(table); strings.Contains(string(b), "empty_since") {
+		t.Fatalf("a table with players must not be empty: %s", b)
+	}
+
+	table.Leave(alice)
+	b, err := json.Marshal(table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Table{}
+	if err := json.Unmarshal(b, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.EmptySince == nil || !loaded.EmptySince.Equal(epoch) {
+		t.Fatalf("empty since %v, expected %s", loaded.EmptySince, epoch)
+	}
+	loaded.Join(alice)
+	if loaded.EmptySince != nil {
+		t.Fatalf("a rejoined table is still empty since %s", loaded.EmptySince)
+	}
+}
+
+func TestDealRespectsMaxHand(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	table := newStartedTable(alice, bob)
+	table.MaxHand = 2
+	table.DeckPile()[0].Take(alice)
+	before := len(table.DeckPile())
+
+	if _, err := table.Deal(OneByOne, 2); err == nil {
+		t.Fatal("dealing beyond alice's limit must fail")
+	}
+	if n := len(table.DeckPile()); n != before {
+		t.Fatalf("a rejected deal took %d cards", before-n)
+	}
+	dealt, err := table.Deal(OneByOne, 1)
+	if err != nil {
+		t.Fatalf("dealing up to the limit must succeed: %s", err)
+	}
+	if len(dealt) != 2 || table.CheckHand(table.Players[alice.ID], 1) == nil {
+		t.Fatalf("%d cards dealt, alice must be at the limit", len(dealt))
+	}
+	if err := table.CheckHand(table.Players[bob.ID], 1); err != nil {
+		t.Fatalf("bob is below the limit: %s", err)
+	}
+}
+
+func TestRequireMember(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	table := newStartedTable(alice)
+
+	if err := table.RequireMember(alice.ID); err != nil {
+		t.Fatalf("alice sits at the table: %s", err)
+	}
+	if err := table.RequireMember(bob.ID); err != ErrNotMember {
+		t.Fatalf("expected %v, actual %v", ErrNotMember, err)
+	}
+	table.Leave(alice)
+	if err := table.RequireMember(alice.ID); err != ErrNotMember {
+		t.Fatalf("alice has left: %v", err)
+	}
+}
+
+func TestItemsAreCreatedByTableClock(t *testing.T) {
+	table := NewTable(uuid.New(), 10)
+	table.SetClock(fixedClock(epoch))
+	table.StartGame()
+	table.Join(newTestUser("alice"))
+
+	for _, it := range table.Items {
+		if it.CreatedAt == nil || !it.CreatedAt.Equal(epoch) {
+			t.Fatalf("item %d is created at %v, expected %s", it.ID, it.CreatedAt, epoch)
+		}
+	}
+}
+
+func TestClearBoardLeavesHandsAndChips(t *testing.T) {
+	alice := newTestUser("alice")
+	table := newStartedTable(alice)
+	pile := table.DeckPile()
+	board := TableItemList{pile[0], pile[1]}
+	for _, it := range board {
+		it.Side = Face
+		it.X, it.Y = 400, 300
+	}
+	hand := pile[2].Take(alice)
+	hand.Side = Face
+	mucked := table.MuckCard(pile[3].Take(alice))
+	kept := map[int]TableItem{}
+	for _, it := range table.Items {
+		if it.Is(ChipClass) || it == hand || it == mucked {
+			kept[it.ID] = *it
+		}
+	}
+	deckBefore := len(table.DeckPile())
+
+	table.ClearBoard()
+
+	if n := len(table.DeckPile()); n != deckBefore+len(board) {
+		t.Fatalf("%d cards in the deck, expected %d", n, deckBefore+len(board))
+	}
+	for _, it := range board {
+		if it.Side != Cover || it.Y != table.DeckY {
+			t.Fatalf("board card %d is not gathered: %+v", it.ID, it)
+		}
+	}
+	for _, it := range table.Items {
+		if prev, found := kept[it.ID]; found && !reflect.DeepEqual(prev, *it) {
+			t.Fatalf("item %d changed: %+v", it.ID, it)
+		}
+	}
+}
+
+func TestItemIDsAreUnique(t *testing.T) {
+	alice, bob := newTestUser("alice"), newTestUser("bob")
+	table := newStartedTable(alice, bob)
+	for i := 0; i < 20; i++ {
+		if _, err := table.Rebuy(table.Players[alice.ID], 1000); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := table.ConjureCard(table.Players[bob.ID], "A", Spades); err != nil {
+			t.Fatal(err)
+		}
+		table.Leave(bob)
+		table.Join(bob)
+		if i == 10 { // the counter must survive a restart
+			b, err := json.Marshal(table)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded := &Table{}
+			if err := json.Unmarshal(b, loaded); err != nil {
+				t.Fatal(err)
+			}
+			table = loaded
+		}
+	}
+
+	ids := map[int]bool{}
+	for _, it := range table.Items {
+		if ids[it.ID] || it.ID == DeckItemID {
+			t.Fatalf("id %d is reused", it.ID)
+		}
+		ids[it.ID] = true
+		if it.ID >= table.NextItemID {
+			t.Fatalf("next item id %d would reuse %d", table.NextItemID, it.ID)
+		}
+	}
+	if len(ids) < 1000 {
+		t.Fatalf("only %d items created", len(ids))
+	}
+}
+
+func TestDroppedConjuredCardsNeedFullState(t *testing.T) {
+	alice := newTestUser("alice")
+	table := newStartedTable(alice)
+	if _, err := table.ConjureCard(table.Players[alice.ID], "A", Spades); err != nil {
+		t.Fatal(err)
+	}
+	table.NotifyPlayers(context.Background(), nil, NewPushItems(table.Items[len(table.Items)-1]))
+	version := table.Version
+
+	table.NewHand(nil)
+	table.NotifyPlayers(context.Background(), nil, NewPushItems(table.Items[0:deckSize]...))
+
+	if ids, ok := table.ChangedSince(version); ok {
+		t.Fatalf("a diff of %d items would keep the dropped conjured card", len(ids))
+	}
+	version = table.Version
+	table.Shuffle() // nothing is dropped
+	table.NotifyPlayers(context.Background(), nil, NewPushItems(table.Items[0:deckSize]...))
+	if _, ok := table.ChangedSince(version); !ok {
+		t.Fatal("a shuffle without conjured cards must not need the full state")
+	}
+}
+
+func TestPinnedCardsStayInPlace(t *testing.T) {
+	alice := newTestUser("alice")
+	table := newStartedTable(alice)
+	pile := table.DeckPile()
+	inDeck, inHand := pile[len(pile)-1], pile[0].Take(alice)
+	inDeck.Pinned, inHand.Pinned = true, true
+	pinned := map[int]TableItem{inDeck.ID: *inDeck, inHand.ID: *inHand}
+	unchanged := func(action string) {
+		t.Helper()
+		for _, it := range []*TableItem{inDeck, inHand} {
+			if !reflect.DeepEqual(pinned[it.ID], *it) {
+				t.Fatalf("%s moved pinned card %d: %+v", action, it.ID, it)
+			}
+		}
+	}
+
+	if top := table.DeckTop(); top == inDeck {
+		t.Fatal("a pinned card must not be the deck top")
+	}
+	if _, err := table.MoveDeck(10, 10); err != nil {
+		t.Fatal(err)
+	}
+	unchanged("move_deck")
+	if _, err := table.Deal(OneByOne, len(table.DeckPile())); err != nil {
+		t.Fatal(err)
+	}
+	unchanged("deal")
+	table.Shuffle()
+	unchanged("shuffle")
+	if n := len(table.DeckPile()); n != deckSize-2 {
+		t.Fatalf("%d cards in the deck after the shuffle, expected all but the pinned ones", n)
+	}
+}
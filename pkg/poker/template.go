@@ -0,0 +1,138 @@
+package poker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+)
+
+// Template is a name of an initial table arrangement
+type Template string
+
+// Available table templates
+const (
+	// Freeform is the default arrangement with no particular game in mind
+	Freeform Template = "freeform"
+	// Holdem arranges the table for Texas hold'em with a community cards zone
+	Holdem Template = "holdem"
+	// Draw arranges the table for draw poker with the deck in the middle
+	Draw Template = "draw"
+)
+
+// tableTemplate describes where the initial objects are put on the table
+type tableTemplate struct {
+	deckX, deckY int
+
+	// bank is where chips of the table bank are laid out, a row per denomination
+	bankX, bankY int
+
+	dealerX, dealerY int
+
+	// community is a zone for community cards if the game has any
+	community *Rect
+}
+
+var templates = map[Template]*tableTemplate{
+	Freeform: {
+		deckX: deckX, deckY: deckY,
+		bankX: 10, bankY: 20,
+		dealerX: 595, dealerY: 315,
+	},
+	Holdem: {
+		deckX: 170, deckY: 280,
+		bankX: 10, bankY: 20,
+		dealerX: 290, dealerY: 440,
+		community: &Rect{X: 340, Y: 215, Width: 600, Height: 290},
+	},
+	Draw: {
+		deckX: 560, deckY: 290,
+		bankX: 10, bankY: 20,
+		dealerX: 440, dealerY: 120,
+	},
+}
+
+// ParseTemplate validates a given template name. Empty name means Freeform
+func ParseTemplate(s string) (Template, error) {
+	if s == "" {
+		return Freeform, nil
+	}
+	if _, found := templates[Template(s)]; !found {
+		return "", httpx.NewError(http.StatusBadRequest, "unknown template: "+s)
+	}
+	return Template(s), nil
+}
+
+// template returns the arrangement of this table, tables without a template are freeform
+func (t *Table) template() *tableTemplate {
+	if tpl, found := templates[t.Template]; found {
+		return tpl
+	}
+	return templates[Freeform]
+}
+
+// templateSpec is a table template as it is described in a templates file
+type templateSpec struct {
+	DeckX     int   `json:"deck_x"`
+	DeckY     int   `json:"deck_y"`
+	BankX     int   `json:"bank_x"`
+	BankY     int   `json:"bank_y"`
+	DealerX   int   `json:"dealer_x"`
+	DealerY   int   `json:"dealer_y"`
+	Community *Rect `json:"community,omitempty"`
+}
+
+func (ts *templateSpec) validate() error {
+	points := map[string][2]int{
+		"deck":   {ts.DeckX, ts.DeckY},
+		"bank":   {ts.BankX, ts.BankY},
+		"dealer": {ts.DealerX, ts.DealerY},
+	}
+	for name, p := range points {
+		if p[0] < 0 || p[1] < 0 || p[0] >= tableWidth || p[1] >= tableHeight {
+			return fmt.Errorf("%s is off the table: %d,%d", name, p[0], p[1])
+		}
+	}
+	if c := ts.Community; c != nil {
+		if c.X < 0 || c.Y < 0 || c.Width <= 0 || c.Height <= 0 ||
+			c.X+c.Width > tableWidth || c.Y+c.Height > tableHeight {
+			return fmt.Errorf("community zone is off the table: %+v", *c)
+		}
+	}
+	return nil
+}
+
+// LoadTemplates reads table templates from a JSON file: an object of template specs
+// by their names. Loaded templates replace the built-in ones with the same names and add new ones.
+// Nothing is changed if any of the templates is invalid
+func LoadTemplates(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	specs := map[Template]*templateSpec{}
+	if err := json.Unmarshal(b, &specs); err != nil {
+		return err
+	}
+	loaded := map[Template]*tableTemplate{}
+	for name, ts := range specs {
+		if name == "" || ts == nil {
+			return fmt.Errorf("template %q: empty", name)
+		}
+		if err := ts.validate(); err != nil {
+			return fmt.Errorf("template %q: %w", name, err)
+		}
+		loaded[name] = &tableTemplate{
+			deckX: ts.DeckX, deckY: ts.DeckY,
+			bankX: ts.BankX, bankY: ts.BankY,
+			dealerX: ts.DealerX, dealerY: ts.DealerY,
+			community: ts.Community,
+		}
+	}
+	for name, tpl := range loaded {
+		templates[name] = tpl
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package poker
+
+import "github.com/google/uuid"
+
+// Wait puts a user to the waitlist of this table and returns
+// the user's 1-based position in it. Waiting twice keeps the position
+func (t *Table) Wait(u *User) int {
+	if pos := t.WaitPosition(u.ID); pos > 0 {
+		return pos
+	}
+	t.Waitlist = append(t.Waitlist, u.ID)
+	return len(t.Waitlist)
+}
+
+// WaitPosition returns 1-based position of a given user in the waitlist, 0 if the user is not waiting
+func (t *Table) WaitPosition(id uuid.UUID) int {
+	for i, it := range t.Waitlist {
+		if it == id {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// StopWaiting removes a given user from the waitlist
+func (t *Table) StopWaiting(id uuid.UUID) {
+	for i, it := range t.Waitlist {
+		if it == id {
+			t.Waitlist = append(t.Waitlist[:i], t.Waitlist[i+1:]...)
+			return
+		}
+	}
+}
+
+// SeatWaiters seats users from the waitlist in order while there are less than max players.
+// Waiters that no longer exist are skipped. It returns the items of all joined players
+func (t *Table) SeatWaiters(users UserMap, max int) []*TableItem {
+	var joined []*TableItem
+	for len(t.Waitlist) > 0 && len(t.Players) < max && !t.Locked {
+		id := t.Waitlist[0]
+		t.Waitlist = t.Waitlist[1:]
+		u, found := users.Get(id)
+		if !found || t.Players[id] != nil || t.IsFull(u, max) {
+			continue
+		}
+		joined = append(joined, t.Join(u)...)
+	}
+	return joined
+}
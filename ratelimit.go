@@ -0,0 +1,77 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/logger"
+)
+
+// rateLimiter allows each user at most a given number of requests within a sliding window
+type rateLimiter struct {
+	lock sync.Mutex
+
+	// max is a number of requests allowed in a window, zero means unlimited
+	max    int
+	window time.Duration
+
+	hits map[uuid.UUID][]time.Time
+}
+
+func newRateLimiter(max int, window time.Duration) *rateLimiter {
+	return &rateLimiter{max: max, window: window, hits: map[uuid.UUID][]time.Time{}}
+}
+
+// allow records a request of a given user if it fits into the window.
+// Otherwise it returns how long the user has to wait
+func (l *rateLimiter) allow(userID uuid.UUID, now time.Time) (time.Duration, bool) {
+	if l.max <= 0 {
+		return 0, true
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for id, hits := range l.hits {
+		if len(hits) > 0 && now.Sub(hits[len(hits)-1]) >= l.window {
+			delete(l.hits, id)
+		}
+	}
+	hits := l.hits[userID]
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= l.window {
+		i++
+	}
+	hits = hits[i:]
+	if len(hits) >= l.max {
+		l.hits[userID] = hits
+		return hits[0].Add(l.window).Sub(now), false
+	}
+	l.hits[userID] = append(hits, now)
+	return 0, true
+}
+
+// rateLimited rejects requests of users who exceeded a given limit with 429 and Retry-After.
+// Requests without a valid session are passed through to be handled by auth wrappers
+func (s *server) rateLimited(l *rateLimiter, f httpx.RequestHandler) httpx.RequestHandler {
+	return func(r *http.Request) (*httpx.Response, error) {
+		sess, err := getUserFromSession(r, s.users)
+		if err != nil || sess.user == nil {
+			return f(r)
+		}
+		wait, ok := l.allow(sess.user.ID, s.clock.Now())
+		if ok {
+			return f(r)
+		}
+		logger.Info.Printf("request_id=%s user_id=%s rate limited, retry in %s",
+			httpx.RequestID(r.Context()), sess.user.ID, wait)
+		retryAfter := strconv.Itoa(int(math.Ceil(wait.Seconds())))
+		return httpx.JSON(http.StatusTooManyRequests, &httpx.ErrorResponse{
+			Error:     "too many requests, try later",
+			RequestID: httpx.RequestID(r.Context()),
+		}).SetHeader("Retry-After", retryAfter), nil
+	}
+}
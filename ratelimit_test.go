@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestRateLimiterWindow(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := newRateLimiter(2, time.Minute)
+	alice, bob := uuid.New(), uuid.New()
+
+	var steps = []struct {
+		user    uuid.UUID
+		at      time.Duration
+		allowed bool
+		wait    time.Duration
+	}{
+		{alice, 0, true, 0},
+		{alice, 10 * time.Second, true, 0},
+		{alice, 20 * time.Second, false, 40 * time.Second},
+		{bob, 20 * time.Second, true, 0}, // users are limited separately
+		{alice, time.Minute - time.Millisecond, false, time.Millisecond},
+		{alice, time.Minute, true, 0}, // the first request has left the window
+		{alice, time.Minute + time.Second, false, 9 * time.Second},
+		{alice, 70 * time.Second, true, 0},
+	}
+	for i, st := range steps {
+		wait, ok := l.allow(st.user, start.Add(st.at))
+		if ok != st.allowed || wait != st.wait {
+			t.Fatalf("step %d at %s: expected %t %s, actual %t %s", i, st.at, st.allowed, st.wait, ok, wait)
+		}
+	}
+}
+
+func TestRateLimiterUnlimited(t *testing.T) {
+	l := newRateLimiter(0, time.Minute)
+	id := uuid.New()
+	for i := 0; i < 100; i++ {
+		if _, ok := l.allow(id, time.Now()); !ok {
+			t.Fatalf("request %d is limited", i)
+		}
+	}
+}
+
+func TestRateLimitedCreate(t *testing.T) {
+	clock := newTestClock()
+	conf := testConfig()
+	conf.maxCreatesPerMin = 1
+	srv := startTestServer(t, conf)
+	srv.clock = clock
+	alice := srv.newClient(t)
+
+	alice.createTable("")
+	clock.Advance(20 * time.Second)
+	resp, b := alice.do("GET", "/games/new", nil)
+	if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "40" {
+		t.Fatalf("status %d Retry-After %q %s", resp.StatusCode, resp.Header.Get("Retry-After"), b)
+	}
+	clock.Advance(40 * time.Second)
+	alice.createTable("")
+}
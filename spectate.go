@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/nchern/vpoker/pkg/httpx"
+	"github.com/nchern/vpoker/pkg/poker"
+)
+
+var errNoTable = httpx.NewError(http.StatusNotFound, "table not found")
+
+func (s *server) shareTable(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	var token string
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can share the table")
+		}
+		token, err = t.Share()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return httpx.JSON(http.StatusOK, m{
+		"token": token,
+		"url":   fmt.Sprintf("/games/%s/spectate/listen?token=%s", ctx.table.ID, token),
+	}), nil
+}
+
+func (s *server) unshareTable(r *http.Request) (*httpx.Response, error) {
+	ctx, err := newContextBuilder(r.Context()).withUser(s, r).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+		if !t.IsCreator(ctx.user) {
+			return httpx.NewError(http.StatusForbidden, "only the creator can revoke sharing")
+		}
+		t.Unshare()
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return httpx.JSON(http.StatusOK, m{}), nil
+}
+
+// spectatorContext builds a context of a read-only spectator validating the share token.
+// Unknown tables and bad tokens are indistinguishable
+func (s *server) spectatorContext(r *http.Request) (*Context, error) {
+	ctx, err := newContextBuilder(r.Context()).withTable(s, r, "id").build()
+	if err != nil {
+		return nil, errNoTable
+	}
+	ctx.user = poker.Spectator
+	token := r.URL.Query().Get("token")
+	if err := ctx.table.ReadLock(ctx, func(t *poker.Table) error {
+		if !t.IsShareToken(token) {
+			return errNoTable
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+func (s *server) spectateState(r *http.Request) (*httpx.Response, error) {
+	ctx, err := s.spectatorContext(r)
+	if err != nil {
+		return nil, err
+	}
+	var tableCopy *poker.Table
+	if err := ctx.table.ReadLock(ctx, func(t *poker.Table) error {
+		tableCopy, err = t.DeepCopy()
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	tableCopy.ApplyVisibilityRules(ctx.user)
+	tableCopy.Items = tableCopy.CompactItems(tableCopy.Items)
+	return httpx.JSON(http.StatusOK, newTableState(tableCopy)).Compressible(), nil
+}
+
+func (s *server) spectateListen(w http.ResponseWriter, r *http.Request) {
+	httpx.H(func(r *http.Request) (*httpx.Response, error) {
+		ctx, err := s.spectatorContext(r)
+		if err != nil {
+			return nil, err
+		}
+		updates := poker.NewUpdates(s.conf.updatesBuffer)
+		var p *poker.Player
+		if err := ctx.table.Update(ctx, func(t *poker.Table) error {
+			if !t.IsShareToken(r.URL.Query().Get("token")) {
+				return errNoTable // revoked in between
+			}
+			p = t.AddSpectator(updates)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+		unsubscribe := func() {
+			logError(ctx.table.Update(context.Background(), func(t *poker.Table) error {
+				t.RemoveSpectator(p)
+				return nil
+			}), "unsubscribe spectator")
+		}
+		return s.servePushes(ctx, w, r, updates, unsubscribe)
+	})(w, r)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+)
+
+// Store persists the server state. Each marshaler is stored as a separate record
+// and gets loaded back into the unmarshaler with the same position
+type Store interface {
+	// Save stores given objects
+	Save(marshalers ...json.Marshaler) error
+
+	// Load loads previously saved objects into given ones
+	Load(unmarshalers ...json.Unmarshaler) error
+}
+
+// stateFile is a Store that keeps the state in a local file, one JSON per line
+type stateFile struct {
+	path string
+	lock sync.RWMutex
+}
+
+// NewStateFile creates a file based Store
+func NewStateFile(path string) Store {
+	return &stateFile{path: path}
+}
+
+func (s *stateFile) Save(marshalers ...json.Marshaler) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if err := os.MkdirAll(path.Dir(s.path), 0700); err != nil {
+		return err
+	}
+	f, err := os.Create(s.path)
+	if err != nil {
+		return err
+	}
+	defer func() { logError(f.Close(), "stateFile.Save os.Create") }()
+	for _, v := range marshalers {
+		b, err := v.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintln(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *stateFile) Load(unmarshalers ...json.Unmarshaler) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	f, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer func() { logError(f.Close(), "stateFile.Load os.Open") }()
+	r := bufio.NewReader(f)
+	for _, v := range unmarshalers {
+		l, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if err := v.UnmarshalJSON([]byte(l)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// memoryStore is a Store that keeps the state in memory only, nothing survives a restart
+type memoryStore struct {
+	records [][]byte
+	lock    sync.RWMutex
+}
+
+// NewMemoryStore creates an in-memory Store
+func NewMemoryStore() Store {
+	return &memoryStore{}
+}
+
+func (s *memoryStore) Save(marshalers ...json.Marshaler) error {
+	records := make([][]byte, 0, len(marshalers))
+	for _, v := range marshalers {
+		b, err := v.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		records = append(records, b)
+	}
+	s.lock.Lock()
+	s.records = records
+	s.lock.Unlock()
+	return nil
+}
+
+func (s *memoryStore) Load(unmarshalers ...json.Unmarshaler) error {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if len(s.records) == 0 {
+		return nil // nothing has been saved yet
+	}
+	if len(s.records) < len(unmarshalers) {
+		return fmt.Errorf("memoryStore.Load: %d records saved, %d requested", len(s.records), len(unmarshalers))
+	}
+	for i, v := range unmarshalers {
+		if err := v.UnmarshalJSON(s.records[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -241,6 +241,9 @@ function onItemMouseDown(e, item) {
     if (item.info.class == 'chip' && isOnOtherPlayerSlot(item)) {
         return;
     }
+    if (item.info.pinned) {
+        return; // pinned items stay put
+    }
 
     let initialMouseX = e.clientX;
     let initialMouseY = e.clientY;
@@ -287,7 +290,7 @@ function onItemMouseDown(e, item) {
         }
         last_ms = now_ms;
 
-        ajax().postJSON(`${window.location.pathname}/update`, item.info);
+        ajax().postJSON(`${window.location.pathname}/update`, updatePayload(item.info));
     }
     document.addEventListener('pointermove', onMouseMove);
 
@@ -299,7 +302,7 @@ function onItemMouseDown(e, item) {
         item.style.zIndex = ''; // to default
         item.info.z_index = 0;
 
-        ajax().postJSON(`${window.location.pathname}/update`, item.info);
+        ajax().error(reconcileConflict).postJSON(`${window.location.pathname}/update`, updatePayload(item.info));
         // cleanup for this drag-n-drop
         document.removeEventListener('pointermove', onMouseMove);
     }, { once: true });
@@ -335,11 +338,16 @@ function renderCard(card) {
     let css = `card_${side}`;
 
     card.style.borderColor = '';
-    card.classList.remove('card_cover', 'card_face', 'owned', 'was_owned');
+    card.classList.remove('card_cover', 'card_face', 'owned', 'was_owned',
+        'card_back_blue', 'card_back_green', 'card_back_gray');
 
     const owner_id = card.info.owner_id;
     if (isOwned(card.info)) {
         setCardBorder(card, owner_id, 'owned');
+        const back = STATE.players[owner_id].card_back;
+        if (side == COVER && back) {
+            card.classList.add(`card_back_${back}`);
+        }
     } else if (card.info.prev_owner_id != '') {
         setCardBorder(card, card.info.prev_owner_id, 'was_owned');
     }
@@ -363,7 +371,39 @@ function onCardDblClick(e, card) {
     card.info.side = card.info.side == COVER ? FACE: COVER;
     ajax().success((resp) => {
         updateItem(resp.updated);
-    }).postJSON(`${window.location.pathname}/update`, card.info)
+    }).error(reconcileConflict).postJSON(`${window.location.pathname}/update`, updatePayload(card.info))
+}
+
+// reconcileConflict puts an item back to its server state if an update was rejected as stale
+function reconcileConflict(err) {
+    if (err.status != 409) {
+        console.error('AJAX.fetch error: ', err);
+        return;
+    }
+    err.body.then((text) => {
+        const resp = JSON.parse(text);
+        if (resp.current) {
+            updateItem(resp.current);
+        }
+    });
+}
+
+// updatePayload picks the fields the update endpoint accepts
+function updatePayload(info) {
+    return {
+        id: info.id,
+        class: info.class,
+        suit: info.suit,
+        rank: info.rank,
+        side: info.side,
+        color: info.color,
+        val: info.val,
+        owner_id: info.owner_id,
+        prev_owner_id: info.prev_owner_id,
+        x: info.x,
+        y: info.y,
+        z_index: info.z_index,
+    };
 }
 
 function newCard(info, x, y) {
@@ -432,6 +472,21 @@ function newDealer(info, x, y) {
     return item;
 }
 
+function newDeck(info, x, y) {
+    const deck = newItem('card', info, x, y);
+    deck.addEventListener('click', (e) => {
+        if (e.button == BUTTON_LEFT && (e.ctrlKey || e.metaKey)) {
+            takeCard(deck);
+        }
+    });
+    deck.render = () => {
+        deck.classList.add('card_cover');
+        deck.innerText = deck.info.count > 0 ? `${deck.info.count}` : '';
+    };
+    deck.render();
+    return deck;
+}
+
 function newPlayer(info, x, y) {
     const item = newItem('player', info, x, y);
     const player = STATE.players[info.owner_id];
@@ -483,6 +538,9 @@ function updateItem(src) {
     if (src.z_index != null && src.z_index != undefined) {
         item.style.zIndex = src.z_index != 0 ? `${src.z_index}` : '';
     }
+    if (!src.z_index && src.z) {
+        item.style.zIndex = `${src.z}`; // server side stacking order
+    }
     item.render();
 }
 
@@ -514,6 +572,8 @@ function createItem(info) {
             return it;
         case 'dealer':
             return newDealer(info, info.x, info.y);
+        case 'deck':
+            return newDeck(info, info.x, info.y);
         case 'player':
             return newPlayer(info, info.x, info.y);
         default:
@@ -542,16 +602,31 @@ function showCard(card) {
     }).postJSON(`${window.location.pathname}/show_card`, {id: card.info.id});
 }
 
-function listenPushes() {
-    const sock = new WebSocket(`ws://${window.location.host}${window.location.pathname}/listen`);
+// DISCONNECT_REASONS are messages for connections closed by the server on purpose,
+// clients do not try to reconnect after them
+const DISCONNECT_REASONS = {
+    'superseded': 'This table has been opened elsewhere. Refresh to play here',
+    'kicked': 'You have left this table',
+    'table_closed': 'This table has been closed',
+    'idle': 'You have been removed from this table for being idle',
+};
+
+function listenPushes(reconnect) {
+    const query = reconnect ? '?reconnect=1' : '';
+    const sock = new WebSocket(`ws://${window.location.host}${window.location.pathname}/listen${query}`);
+    let disconnectedBy = null;
     sock.onopen = () => {
         console.log('websocket connected');
         hideElem(document.getElementById('error-banner'));
     };
     sock.onclose = () => {
         console.log('websocket disconnected');
+        if (disconnectedBy) {
+            showError(disconnectedBy);
+            return;
+        }
         showError('OFFLINE. Try to refresh');
-        setTimeout(() => { socket = listenPushes(); }, 10 * SECOND);
+        setTimeout(() => { socket = listenPushes(true); }, 10 * SECOND);
     };
     sock.onerror = (err) => {
         console.error('websocket error:', err);
@@ -567,14 +642,26 @@ function listenPushes() {
         }
         switch (resp.type) {
         case 'player_joined':
+        case 'player_folded':
             updateTable(resp);
             break;
+        case 'players_updated':
+            STATE.players = resp.players;
+            document.querySelectorAll('.slot').forEach(updateSlotsWithMoney);
+            break;
         case 'update_items':
             updateItems(resp.items);
             break;
         case 'refresh':
             location.reload();
             break;
+        case 'disconnect':
+            disconnectedBy = DISCONNECT_REASONS[resp.reason] || null;
+            break;
+        case 'player_idle':
+            showError(resp.message);
+            setTimeout(() => { hideElem(document.getElementById('error-banner')); }, 5 * SECOND);
+            break;
         default:
             console.log("push unknown:", resp);
         }